@@ -0,0 +1,490 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"traefik-tower/config"
+	"traefik-tower/handlers"
+	"traefik-tower/pkg/acp"
+	"traefik-tower/pkg/apikey"
+	"traefik-tower/pkg/audit"
+	"traefik-tower/pkg/decision"
+	"traefik-tower/pkg/keto"
+	"traefik-tower/pkg/redact"
+
+	"github.com/rs/zerolog"
+)
+
+// command runs a subcommand and returns the process exit code
+type command struct {
+	usage string
+	run   func(args []string) int
+}
+
+var commands = map[string]command{
+	"acp": {
+		usage: "acp check [-policies paths] [-flavor glob] subject resource|-uri path action  evaluate the acp policies",
+		run:   acpCommand,
+	},
+	"apikey": {
+		usage: "apikey create|list|revoke [-file path] ...  manage the api key store",
+		run:   apiKeyCommand,
+	},
+	"audit": {
+		usage: "audit verify [-file path] [files...]  verify the audit log hash chain",
+		run:   auditCommand,
+	},
+	"check": {
+		usage: "check [-file path] -token t [-method GET] -host h -uri path  dry run a forward auth request with the config",
+		run:   checkCommand,
+	},
+	"keto": {
+		usage: "keto sync [-keto-url url] [-flavor glob] [-prune] [-apply] files...  sync acp policies and roles to keto",
+		run:   ketoCommand,
+	},
+	"validate-config": {
+		usage: "validate-config [-file path]  load and validate the config from the environment and config file",
+		run:   validateConfigCommand,
+	},
+}
+
+func runCommand(name string, args []string) int {
+	cmd, ok := commands[name]
+	if !ok {
+		usage()
+		return 2
+	}
+
+	// the http client dumps requests at debug level
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+
+	return cmd.run(args)
+}
+
+func usage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(os.Stderr, "usage: traefik-tower [command]")
+	fmt.Fprintln(os.Stderr, "without a command the auth server is started\n\ncommands:")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n", commands[name].usage)
+	}
+}
+
+func auditCommand(args []string) int {
+	if len(args) < 1 || args[0] != "verify" {
+		fmt.Fprintln(os.Stderr, "usage: traefik-tower audit verify [-file path] [files...]")
+		return 2
+	}
+
+	fs := flag.NewFlagSet("audit verify", flag.ContinueOnError)
+	file := fs.String("file", os.Getenv("AUDIT_FILE"), "audit log file, rotated files next to it are verified first")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	files := fs.Args()
+	if len(files) == 0 {
+		if *file == "" {
+			fmt.Fprintln(os.Stderr, "audit verify: no audit file given")
+			return 2
+		}
+		files = audit.Files(*file)
+	}
+
+	res, err := audit.Verify(files)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "audit verify: %s\n", err)
+		return 1
+	}
+
+	fmt.Printf("ok: %d records, seq %d-%d\n", res.Records, res.FirstSeq, res.LastSeq)
+	if res.Truncated {
+		fmt.Printf("note: the first record links to an older record that is not present\n")
+	}
+
+	return 0
+}
+
+// headerFlags collects repeated -header "Name: value" flags
+type headerFlags map[string]string
+
+func (hf headerFlags) String() string {
+	return ""
+}
+
+func (hf headerFlags) Set(v string) error {
+	i := strings.Index(v, ":")
+	if i <= 0 {
+		return fmt.Errorf("%q is not Name: value", v)
+	}
+	hf[strings.TrimSpace(v[:i])] = strings.TrimSpace(v[i+1:])
+	return nil
+}
+
+func checkCommand(args []string) int {
+	const usageText = "usage: traefik-tower check [-file path] [-token t|-] [-method GET] [-host h] -uri path [-tenant name] [-client-ip ip] [-header 'Name: value']... [-json]" // nolint: lll
+
+	headers := headerFlags{}
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+	file := fs.String("file", os.Getenv(config.EnvConfigFile), "config file, defaults to $"+config.EnvConfigFile)
+	token := fs.String("token", "", "bearer token, - reads it from stdin")
+	method := fs.String("method", http.MethodGet, "forwarded method")
+	host := fs.String("host", "", "forwarded host")
+	uri := fs.String("uri", "", "forwarded uri")
+	tenant := fs.String("tenant", "", "tenant name, selected by host by default")
+	clientIP := fs.String("client-ip", "", "forwarded client ip")
+	asJSON := fs.Bool("json", false, "print the explanation as JSON")
+	debug := fs.Bool("debug", false, "log the upstream requests")
+	fs.Var(headers, "header", "extra request header, e.g. 'X-Api-Key: ...', repeatable")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *uri == "" || !strings.HasPrefix(*uri, "/") || fs.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, usageText)
+		return 2
+	}
+	if *debug {
+		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	}
+
+	if *token == "-" {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			fmt.Fprintf(os.Stderr, "check: %s\n", err)
+			return 2
+		}
+		*token = strings.TrimSpace(line)
+	}
+
+	cfg, err := config.Load(*file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	redact.AddClaims(cfg.RedactClaims...)
+	redact.AddClaims(cfg.APIKeyQueryParam)
+	redact.AddHeaders(cfg.APIKeyHeader)
+
+	_, tenants, err := newTenantRouter(cfg, &sharedDeps{})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "check: %s\n", err)
+		return 2
+	}
+
+	resp, err := tenants.Explain(context.Background(), &handlers.ExplainRequest{
+		Token:    *token,
+		Method:   *method,
+		Host:     *host,
+		URI:      *uri,
+		ClientIP: *clientIP,
+		Tenant:   *tenant,
+		Headers:  headers,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "check: %s\n", err)
+		return 2
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(resp); err != nil {
+			fmt.Fprintf(os.Stderr, "check: %s\n", err)
+			return 2
+		}
+	} else {
+		printExplain(resp)
+	}
+
+	switch resp.Outcome {
+	case decision.OutcomeAllow:
+		return 0
+	case decision.OutcomeDeny:
+		return 1
+	}
+
+	return 2
+}
+
+func printExplain(resp *handlers.ExplainResponse) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if resp.Tenant != "" {
+		fmt.Fprintf(tw, "tenant\t%s\n", resp.Tenant)
+	}
+	fmt.Fprintf(tw, "auth type\t%s\n", resp.AuthType)
+	for _, st := range resp.Steps {
+		out, _ := json.Marshal(st.Output)
+		fmt.Fprintf(tw, "%s\t%s\n", st.Stage, out)
+	}
+	fmt.Fprintf(tw, "decision\t%s (%s), status %d\n", resp.Outcome, resp.Reason, resp.Status)
+	if resp.Error != "" {
+		fmt.Fprintf(tw, "error\t%s\n", resp.Error)
+	}
+
+	names := make([]string, 0, len(resp.Headers))
+	for name := range resp.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(tw, "header\t%s: %s\n", name, resp.Headers[name])
+	}
+	tw.Flush()
+}
+
+func validateConfigCommand(args []string) int {
+	fs := flag.NewFlagSet("validate-config", flag.ContinueOnError)
+	file := fs.String("file", os.Getenv(config.EnvConfigFile), "config file, defaults to $"+config.EnvConfigFile)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if _, err := config.Load(*file); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	fmt.Println("config is valid")
+
+	return 0
+}
+
+func apiKeyCommand(args []string) int {
+	const usageText = `usage: traefik-tower apikey create -owner name [-roles a,b] [-scopes a,b] [-routes a,b] [-ttl 720h] [-file path]
+       traefik-tower apikey list [-file path]
+       traefik-tower apikey revoke [-file path] id`
+
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, usageText)
+		return 2
+	}
+
+	fs := flag.NewFlagSet("apikey "+args[0], flag.ContinueOnError)
+	file := fs.String("file", envOr("API_KEY_FILE", "apikeys.json"), "api key store, defaults to $API_KEY_FILE")
+	owner := fs.String("owner", "", "consumer id returned for the key")
+	roles := fs.String("roles", "", "comma separated roles")
+	scopes := fs.String("scopes", "", "comma separated scopes")
+	routes := fs.String("routes", "", "comma separated route rule names the key is limited to")
+	ttl := fs.Duration("ttl", 0, "key lifetime, 0 never expires")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	store, err := apikey.Open(*file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "apikey: %s\n", err)
+		return 1
+	}
+
+	switch args[0] {
+	case "create":
+		if *owner == "" {
+			fmt.Fprintln(os.Stderr, "apikey create: -owner is required")
+			return 2
+		}
+
+		plain, k, err := store.Create(apikey.Key{
+			Owner:  *owner,
+			Roles:  splitList(*roles),
+			Scopes: splitList(*scopes),
+			Routes: splitList(*routes),
+		}, *ttl)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "apikey create: %s\n", err)
+			return 1
+		}
+
+		fmt.Printf("id: %s\nkey: %s\n", k.ID, plain)
+		fmt.Fprintln(os.Stderr, "the key is not stored and can not be shown again")
+	case "list":
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tOWNER\tROLES\tSCOPES\tROUTES\tCREATED\tEXPIRES\tSTATUS")
+		now := time.Now()
+		for _, k := range store.List() {
+			expires := "never"
+			if k.ExpiresAt != nil {
+				expires = k.ExpiresAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", k.ID, k.Owner,
+				strings.Join(k.Roles, ","), strings.Join(k.Scopes, ","), strings.Join(k.Routes, ","),
+				k.CreatedAt.Format(time.RFC3339), expires, k.Status(now))
+		}
+		tw.Flush()
+	case "revoke":
+		if fs.NArg() != 1 {
+			fmt.Fprintln(os.Stderr, usageText)
+			return 2
+		}
+		if err := store.Revoke(fs.Arg(0)); err != nil {
+			fmt.Fprintf(os.Stderr, "apikey revoke: %s\n", err)
+			return 1
+		}
+		fmt.Printf("revoked %s\n", fs.Arg(0))
+	default:
+		fmt.Fprintln(os.Stderr, usageText)
+		return 2
+	}
+
+	return 0
+}
+
+func acpCommand(args []string) int {
+	const usageText = `usage: traefik-tower acp check [-policies a.yaml,dir] [-flavor glob] subject resource action
+       traefik-tower acp check [-policies a.yaml,dir] [-flavor glob] -uri /api/items subject action`
+
+	if len(args) < 1 || args[0] != "check" {
+		fmt.Fprintln(os.Stderr, usageText)
+		return 2
+	}
+
+	fs := flag.NewFlagSet("acp check", flag.ContinueOnError)
+	policies := fs.String("policies", os.Getenv("ACP_POLICIES"), "comma separated policy files and directories, defaults to $ACP_POLICIES")
+	flavor := fs.String("flavor", envOr("ACP_FLAVOR", acp.FlavorGlob), "exact, glob or regex")
+	uri := fs.String("uri", "", "forwarded uri, mapped to the resource like the auth server does")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	var subject, resource, action string
+	switch {
+	case *uri != "" && fs.NArg() == 2:
+		subject, resource, action = fs.Arg(0), acp.Resource(*uri), fs.Arg(1)
+	case *uri == "" && fs.NArg() == 3:
+		subject, resource, action = fs.Arg(0), fs.Arg(1), fs.Arg(2)
+	default:
+		fmt.Fprintln(os.Stderr, usageText)
+		return 2
+	}
+
+	engine, err := acp.Load(*flavor, splitList(*policies))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "acp check: %s\n", err)
+		return 2
+	}
+
+	allowed, matched := engine.Allowed(subject, resource, action)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "subject\t%s\nresource\t%s\naction\t%s\n", subject, resource, action)
+	for _, p := range matched {
+		fmt.Fprintf(tw, "matched\t%s (%s)\n", p.ID, p.Effect)
+	}
+	if allowed {
+		fmt.Fprintln(tw, "decision\tallow")
+	} else {
+		fmt.Fprintln(tw, "decision\tdeny")
+	}
+	tw.Flush()
+
+	if !allowed {
+		return 1
+	}
+
+	return 0
+}
+
+func ketoCommand(args []string) int {
+	const usageText = "usage: traefik-tower keto sync [-keto-url url] [-flavor glob] [-prune] [-apply] a.yaml|dir..."
+
+	if len(args) < 1 || args[0] != "sync" {
+		fmt.Fprintln(os.Stderr, usageText)
+		return 2
+	}
+
+	fs := flag.NewFlagSet("keto sync", flag.ContinueOnError)
+	ketoURL := fs.String("keto-url", os.Getenv("KETO_URL"), "keto admin url, defaults to $KETO_URL")
+	flavor := fs.String("flavor", envOr("ACP_FLAVOR", acp.FlavorGlob), "exact, glob or regex")
+	prune := fs.Bool("prune", false, "delete policies and roles missing from the files")
+	apply := fs.Bool("apply", false, "apply the plan, without it only the plan is printed")
+	debug := fs.Bool("debug", false, "log the keto requests")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if *ketoURL == "" || fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, usageText)
+		return 2
+	}
+	if *debug {
+		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	}
+
+	want, err := acp.LoadFiles(fs.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "keto sync: %s\n", err)
+		return 2
+	}
+
+	c, err := keto.NewClient(*ketoURL, *flavor)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "keto sync: %s\n", err)
+		return 2
+	}
+	policies, err := c.Policies()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "keto sync: %s\n", err)
+		return 2
+	}
+	roles, err := c.Roles()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "keto sync: %s\n", err)
+		return 2
+	}
+
+	changes := keto.Plan(want, policies, roles, *prune)
+	pending := 0
+	for _, ch := range changes {
+		fmt.Println(ch)
+		if ch.Op != keto.OpExtra {
+			pending++
+		}
+	}
+	if pending == 0 {
+		fmt.Printf("keto %s is up to date (%d policies, %d roles)\n", *flavor, len(want.Policies), len(want.Roles))
+		return 0
+	}
+	if !*apply {
+		fmt.Printf("%d changes, run with -apply to apply them\n", pending)
+		return 0
+	}
+
+	if err := c.Apply(changes); err != nil {
+		fmt.Fprintf(os.Stderr, "keto sync: %s\n", err)
+		return 2
+	}
+	fmt.Printf("applied %d changes\n", pending)
+
+	return 0
+}
+
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
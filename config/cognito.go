@@ -0,0 +1,94 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultCognitoPoolName names the pool set with COGNITO_USER_POOL_ID and COGNITO_APP_CLIENT_ID
+const DefaultCognitoPoolName = "default"
+
+// CognitoPool is a user pool accepted in cognito-aws mode, selected by the token issuer
+type CognitoPool struct {
+	Name       string `yaml:"name" toml:"name"`
+	UserPoolID string `yaml:"user_pool_id" toml:"user_pool_id"`
+	// Region defaults to the region prefix of the user pool id
+	Region string `yaml:"region" toml:"region"`
+	// Profile is the AWS shared config profile, defaults to aws_profile
+	Profile string `yaml:"profile" toml:"profile"`
+	// AppClientIDs restricts the accepted app clients, empty accepts all
+	AppClientIDs []string `yaml:"app_client_ids" toml:"app_client_ids"`
+}
+
+// Issuer is the iss claim of tokens issued by the pool
+func (p *CognitoPool) Issuer() string {
+	return fmt.Sprintf("https://cognito-idp.%s.amazonaws.com/%s", p.GetRegion(), p.UserPoolID)
+}
+
+func (p *CognitoPool) GetRegion() string {
+	if p.Region != "" {
+		return p.Region
+	}
+	if i := strings.Index(p.UserPoolID, "_"); i > 0 {
+		return p.UserPoolID[:i]
+	}
+	return ""
+}
+
+// CognitoUserPools returns the configured pools, including the one set by the single pool settings
+func (c *Config) CognitoUserPools() []CognitoPool {
+	pools := make([]CognitoPool, 0, len(c.CognitoPools)+1)
+
+	if c.CognitoUserPoolID != "" {
+		p := CognitoPool{
+			Name:       DefaultCognitoPoolName,
+			UserPoolID: c.CognitoUserPoolID,
+			Region:     c.AwsRegion,
+			Profile:    c.AwsProfile,
+		}
+		if c.CognitoAppClientID != "" {
+			p.AppClientIDs = []string{c.CognitoAppClientID}
+		}
+		pools = append(pools, p)
+	}
+
+	for _, p := range c.CognitoPools {
+		if p.Profile == "" {
+			p.Profile = c.AwsProfile
+		}
+		pools = append(pools, p)
+	}
+
+	return pools
+}
+
+func (c *Config) validateCognitoPools() []string {
+	var problems []string
+
+	names := map[string]bool{}
+	issuers := map[string]string{}
+	for i, p := range c.CognitoUserPools() {
+		prefix := fmt.Sprintf("cognito_pools[%d]", i)
+		if p.Name == "" {
+			problems = append(problems, prefix+".name: must be set")
+		} else {
+			prefix = fmt.Sprintf("cognito_pools[%s]", p.Name)
+			if names[p.Name] {
+				problems = append(problems, prefix+": duplicate pool name")
+			}
+			names[p.Name] = true
+		}
+
+		if !strings.Contains(p.UserPoolID, "_") {
+			problems = append(problems, fmt.Sprintf("%s.user_pool_id: %q must look like <region>_<id>", prefix, p.UserPoolID))
+			continue
+		}
+
+		if other, ok := issuers[p.Issuer()]; ok {
+			problems = append(problems, fmt.Sprintf("%s: same user pool as %s, list its app clients in one pool", prefix, other))
+		}
+		issuers[p.Issuer()] = p.Name
+	}
+
+	return problems
+}
@@ -1,27 +1,212 @@
 package config
 
 import (
+	"time"
+
 	"github.com/caarlos0/env"
+
+	"traefik-tower/pkg/route"
+)
+
+const (
+	AuthTypeHydra      = "hydra"
+	AuthTypeHydraKeto  = "hydra-keto"
+	AuthTypeCognito    = "cognito"
+	AuthTypeCognitoAWS = "cognito-aws"
+	AuthTypeKratos     = "kratos"
+	AuthTypeKratosKeto = "kratos-keto"
+	AuthTypeAPIKey     = "api-key"
+	AuthTypeMTLS       = "mtls"
+	AuthTypeMTLSKeto   = "mtls-keto"
+	AuthTypeBasic      = "basic"
+	AuthTypeBasicKeto  = "basic-keto"
+	AuthTypeLDAP       = "ldap"
+	AuthTypeLDAPKeto   = "ldap-keto"
 )
 
+var AuthTypes = []string{
+	AuthTypeHydra, AuthTypeHydraKeto, AuthTypeCognito, AuthTypeCognitoAWS, AuthTypeKratos, AuthTypeKratosKeto, AuthTypeAPIKey,
+	AuthTypeMTLS, AuthTypeMTLSKeto, AuthTypeBasic, AuthTypeBasicKeto,
+	AuthTypeLDAP, AuthTypeLDAPKeto,
+}
+
+// EnvConfigFile names the optional YAML or TOML config file, see Load
+const EnvConfigFile = "CONFIG_FILE"
+
 type Config struct {
-	Port               string `env:"PORT" envDefault:"8000"`
-	Host               string `env:"HOST" envDefault:"0.0.0.0"`
-	AuthServerURL      string `env:"AUTH_SERVER_URL" envDefault:""`
-	KetoURL            string `env:"KETO_URL" envDefault:""`
-	KetoResource       string `env:"KETO_RESOURCE" envDefault:""`
-	AuthType           string `env:"AUTH_TYPE"`
-	AwsRegion          string `env:"AWS_REGION" envDefault:"eu-west-1"`
-	AwsProfile         string `env:"AWS_PROFILE" envDefault:""`
-	AwsUseContext      bool   `env:"AWS_USE_CONTEXT" envDefault:"true"`
-	CognitoAppClientID string `env:"COGNITO_APP_CLIENT_ID" envDefault:""`
-	CognitoUserPoolID  string `env:"COGNITO_USER_POOL_ID" envDefault:""`
-	Debug              bool   `env:"DEBUG"`
-	TracingDebug       string `env:"TRACING_DEBUG"`
+	Port               string `env:"PORT" envDefault:"8000" yaml:"port" toml:"port"`
+	Host               string `env:"HOST" envDefault:"0.0.0.0" yaml:"host" toml:"host"`
+	AuthServerURL      string `env:"AUTH_SERVER_URL" envDefault:"" yaml:"auth_server_url" toml:"auth_server_url"`
+	KetoURL            string `env:"KETO_URL" envDefault:"" yaml:"keto_url" toml:"keto_url"`
+	KetoResource       string `env:"KETO_RESOURCE" envDefault:"" yaml:"keto_resource" toml:"keto_resource"`
+	AuthType           string `env:"AUTH_TYPE" envDefault:"hydra" yaml:"auth_type" toml:"auth_type"`
+	AwsRegion          string `env:"AWS_REGION" envDefault:"eu-west-1" yaml:"aws_region" toml:"aws_region"`
+	AwsProfile         string `env:"AWS_PROFILE" envDefault:"" yaml:"aws_profile" toml:"aws_profile"`
+	AwsUseContext      bool   `env:"AWS_USE_CONTEXT" envDefault:"true" yaml:"aws_use_context" toml:"aws_use_context"`
+	CognitoAppClientID string `env:"COGNITO_APP_CLIENT_ID" envDefault:"" yaml:"cognito_app_client_id" toml:"cognito_app_client_id"`
+	CognitoUserPoolID  string `env:"COGNITO_USER_POOL_ID" envDefault:"" yaml:"cognito_user_pool_id" toml:"cognito_user_pool_id"`
+	Debug              bool   `env:"DEBUG" yaml:"debug" toml:"debug"`
+	TracingDebug       string `env:"TRACING_DEBUG" yaml:"tracing_debug" toml:"tracing_debug"`
+
+	// Kratos session settings, auth_server_url is the Kratos public URL. The role trait is the Keto subject
+	// in kratos-keto mode. Sessions are cached until they expire, at most kratos_cache_ttl when set.
+	KratosSessionCookie string        `env:"KRATOS_SESSION_COOKIE" envDefault:"ory_kratos_session" yaml:"kratos_session_cookie" toml:"kratos_session_cookie"` // nolint: lll
+	KratosRoleTrait     string        `env:"KRATOS_ROLE_TRAIT" yaml:"kratos_role_trait" toml:"kratos_role_trait"`
+	KratosCacheSize     int           `env:"KRATOS_CACHE_SIZE" envDefault:"10000" yaml:"kratos_cache_size" toml:"kratos_cache_size"`
+	KratosCacheTTL      time.Duration `env:"KRATOS_CACHE_TTL" envDefault:"0" yaml:"kratos_cache_ttl" toml:"kratos_cache_ttl"`
+	// KratosTraitHeaders maps identity traits to response headers, only configurable from the config file
+	KratosTraitHeaders map[string]string `yaml:"kratos_trait_headers" toml:"kratos_trait_headers"`
+
+	// API keys are managed with the apikey subcommand. api_key_query_param reads the key from the query
+	// of the forwarded URI, it is off when empty.
+	APIKeyFile       string `env:"API_KEY_FILE" envDefault:"apikeys.json" yaml:"api_key_file" toml:"api_key_file"`
+	APIKeyHeader     string `env:"API_KEY_HEADER" envDefault:"X-Api-Key" yaml:"api_key_header" toml:"api_key_header"`
+	APIKeyQueryParam string `env:"API_KEY_QUERY_PARAM" yaml:"api_key_query_param" toml:"api_key_query_param"`
+
+	// mTLS verifies the client certificate forwarded by a trusted proxy. The consumer id is taken from
+	// the subject CN or the first dns, email, uri or spiffe SAN, the Keto subject in mtls-keto mode.
+	MTLSCAFiles            []string `env:"MTLS_CA_FILES" envSeparator:"," yaml:"mtls_ca_files" toml:"mtls_ca_files"`
+	MTLSCRLFiles           []string `env:"MTLS_CRL_FILES" envSeparator:"," yaml:"mtls_crl_files" toml:"mtls_crl_files"`
+	MTLSConsumerID         string   `env:"MTLS_CONSUMER_ID" envDefault:"cn" yaml:"mtls_consumer_id" toml:"mtls_consumer_id"`
+	MTLSSpiffeTrustDomains []string `env:"MTLS_SPIFFE_TRUST_DOMAINS" envSeparator:"," yaml:"mtls_spiffe_trust_domains" toml:"mtls_spiffe_trust_domains"` // nolint: lll
+
+	// Basic auth users come from an htpasswd file with bcrypt, {SHA} or $apr1$ hashes, their groups from an
+	// optional Apache group file. Both are reloaded on change. A user failing basic_auth_max_failures times
+	// from one client ip is throttled for the rest of basic_auth_failure_window, 0 disables throttling.
+	BasicAuthFile          string        `env:"BASIC_AUTH_FILE" yaml:"basic_auth_file" toml:"basic_auth_file"`
+	BasicAuthGroupFile     string        `env:"BASIC_AUTH_GROUP_FILE" yaml:"basic_auth_group_file" toml:"basic_auth_group_file"`
+	BasicAuthRealm         string        `env:"BASIC_AUTH_REALM" envDefault:"traefik-tower" yaml:"basic_auth_realm" toml:"basic_auth_realm"`
+	BasicAuthMaxFailures   int           `env:"BASIC_AUTH_MAX_FAILURES" envDefault:"5" yaml:"basic_auth_max_failures" toml:"basic_auth_max_failures"`        // nolint: lll
+	BasicAuthFailureWindow time.Duration `env:"BASIC_AUTH_FAILURE_WINDOW" envDefault:"5m" yaml:"basic_auth_failure_window" toml:"basic_auth_failure_window"` // nolint: lll
+
+	// LDAP takes basic auth credentials, binds with the service account, searches the user with ldap_user_filter
+	// and binds as the user. Groups are read from ldap_group_attribute on the user entry or, with ldap_group_filter,
+	// searched below ldap_group_base_dn. %s in the filters is the user name or the user DN. The basic_auth_max_failures
+	// throttling applies. Successful binds are cached for ldap_cache_ttl, 0 disables the cache.
+	LDAPURL                string        `env:"LDAP_URL" yaml:"ldap_url" toml:"ldap_url"`
+	LDAPStartTLS           bool          `env:"LDAP_START_TLS" yaml:"ldap_start_tls" toml:"ldap_start_tls"`
+	LDAPCAFile             string        `env:"LDAP_CA_FILE" yaml:"ldap_ca_file" toml:"ldap_ca_file"`
+	LDAPBindDN             string        `env:"LDAP_BIND_DN" yaml:"ldap_bind_dn" toml:"ldap_bind_dn"`
+	LDAPBindPassword       string        `env:"LDAP_BIND_PASSWORD" yaml:"ldap_bind_password" toml:"ldap_bind_password"`
+	LDAPBaseDN             string        `env:"LDAP_BASE_DN" yaml:"ldap_base_dn" toml:"ldap_base_dn"`
+	LDAPUserFilter         string        `env:"LDAP_USER_FILTER" envDefault:"(uid=%s)" yaml:"ldap_user_filter" toml:"ldap_user_filter"`
+	LDAPGroupAttribute     string        `env:"LDAP_GROUP_ATTRIBUTE" envDefault:"memberOf" yaml:"ldap_group_attribute" toml:"ldap_group_attribute"`
+	LDAPGroupBaseDN        string        `env:"LDAP_GROUP_BASE_DN" yaml:"ldap_group_base_dn" toml:"ldap_group_base_dn"`
+	LDAPGroupFilter        string        `env:"LDAP_GROUP_FILTER" yaml:"ldap_group_filter" toml:"ldap_group_filter"`
+	LDAPGroupNameAttribute string        `env:"LDAP_GROUP_NAME_ATTRIBUTE" envDefault:"cn" yaml:"ldap_group_name_attribute" toml:"ldap_group_name_attribute"` // nolint: lll
+	LDAPPoolSize           int           `env:"LDAP_POOL_SIZE" envDefault:"4" yaml:"ldap_pool_size" toml:"ldap_pool_size"`
+	LDAPTimeout            time.Duration `env:"LDAP_TIMEOUT" envDefault:"5s" yaml:"ldap_timeout" toml:"ldap_timeout"`
+	LDAPCacheTTL           time.Duration `env:"LDAP_CACHE_TTL" envDefault:"30s" yaml:"ldap_cache_ttl" toml:"ldap_cache_ttl"`
+	LDAPCacheSize          int           `env:"LDAP_CACHE_SIZE" envDefault:"10000" yaml:"ldap_cache_size" toml:"ldap_cache_size"`
+
+	// ACPPolicies are ORY ACP policy files or directories evaluated in process instead of calling Keto in
+	// the *-keto auth types, keto_url is not used then. acp_flavor is exact, glob or regex like the Keto engines.
+	// The files are read again on config reload.
+	ACPPolicies []string `env:"ACP_POLICIES" envSeparator:"," yaml:"acp_policies" toml:"acp_policies"`
+	ACPFlavor   string   `env:"ACP_FLAVOR" envDefault:"glob" yaml:"acp_flavor" toml:"acp_flavor"`
+
+	// OPA asks the Data API of an OPA sidecar at opa_url for the decision on every authenticated request,
+	// POST /v1/data/{opa_path}. The input holds the forwarded request, the identity with its claims and
+	// roles and the Hydra client metadata. The result is a boolean or an object with allow and headers.
+	OPAURL  string `env:"OPA_URL" yaml:"opa_url" toml:"opa_url"`
+	OPAPath string `env:"OPA_PATH" envDefault:"traefik/authz" yaml:"opa_path" toml:"opa_path"`
+
+	// TrustedProxies are IPs and CIDRs whose forwarded headers are honored, empty trusts every peer
+	TrustedProxies []string `env:"TRUSTED_PROXIES" envSeparator:"," yaml:"trusted_proxies" toml:"trusted_proxies"`
+
+	// ExtAuthzPort enables the Envoy ext_authz gRPC listener on host:ext_authz_port
+	ExtAuthzPort string `env:"EXT_AUTHZ_PORT" envDefault:"" yaml:"ext_authz_port" toml:"ext_authz_port"`
+	// ExtAuthzTLSCertFile and ExtAuthzTLSKeyFile serve the listener over TLS, with ExtAuthzTLSClientCAFile
+	// only clients with a certificate it signed may connect
+	ExtAuthzTLSCertFile     string `env:"EXT_AUTHZ_TLS_CERT_FILE" yaml:"ext_authz_tls_cert_file" toml:"ext_authz_tls_cert_file"`
+	ExtAuthzTLSKeyFile      string `env:"EXT_AUTHZ_TLS_KEY_FILE" yaml:"ext_authz_tls_key_file" toml:"ext_authz_tls_key_file"`
+	ExtAuthzTLSClientCAFile string `env:"EXT_AUTHZ_TLS_CLIENT_CA_FILE" yaml:"ext_authz_tls_client_ca_file" toml:"ext_authz_tls_client_ca_file"` // nolint: lll
+
+	TracingExporter    string   `env:"TRACING_EXPORTER" envDefault:"otlp" yaml:"tracing_exporter" toml:"tracing_exporter"`
+	TracingPropagators []string `env:"TRACING_PROPAGATORS" envSeparator:"," envDefault:"tracecontext,baggage,jaeger" yaml:"tracing_propagators" toml:"tracing_propagators"` // nolint: lll
+	TracingServiceName string   `env:"TRACING_SERVICE_NAME" envDefault:"traefik-tower" yaml:"tracing_service_name" toml:"tracing_service_name"`
+
+	// RedactClaims are extra claim, form field and query param names masked in debug logs
+	RedactClaims []string `env:"REDACT_CLAIMS" envSeparator:"," yaml:"redact_claims" toml:"redact_claims"`
+
+	AccessLog           bool    `env:"ACCESS_LOG" envDefault:"true" yaml:"access_log" toml:"access_log"`
+	AccessLogOutput     string  `env:"ACCESS_LOG_OUTPUT" envDefault:"stdout" yaml:"access_log_output" toml:"access_log_output"`
+	AccessLogSampleRate float64 `env:"ACCESS_LOG_SAMPLE_RATE" envDefault:"1" yaml:"access_log_sample_rate" toml:"access_log_sample_rate"`
+
+	Audit               bool          `env:"AUDIT" envDefault:"false" yaml:"audit" toml:"audit"`
+	AuditSink           string        `env:"AUDIT_SINK" envDefault:"file" yaml:"audit_sink" toml:"audit_sink"`
+	AuditFile           string        `env:"AUDIT_FILE" envDefault:"audit.log" yaml:"audit_file" toml:"audit_file"`
+	AuditFileMaxSizeMB  int           `env:"AUDIT_FILE_MAX_SIZE_MB" envDefault:"100" yaml:"audit_file_max_size_mb" toml:"audit_file_max_size_mb"` // nolint: lll
+	AuditFileMaxBackups int           `env:"AUDIT_FILE_MAX_BACKUPS" envDefault:"10" yaml:"audit_file_max_backups" toml:"audit_file_max_backups"`  // nolint: lll
+	AuditWebhookURL     string        `env:"AUDIT_WEBHOOK_URL" envDefault:"" yaml:"audit_webhook_url" toml:"audit_webhook_url"`
+	AuditWebhookTimeout time.Duration `env:"AUDIT_WEBHOOK_TIMEOUT" envDefault:"5s" yaml:"audit_webhook_timeout" toml:"audit_webhook_timeout"`
+	AuditWebhookSpool   string        `env:"AUDIT_WEBHOOK_SPOOL" envDefault:"audit-spool" yaml:"audit_webhook_spool" toml:"audit_webhook_spool"`
+
+	// Login redirects unauthenticated browsers to the authorization server, the session is kept
+	// in an encrypted cookie. It applies to all tenants and uses the top level settings.
+	Login             bool          `env:"LOGIN" envDefault:"false" yaml:"login" toml:"login"`
+	LoginAuthorizeURL string        `env:"LOGIN_AUTHORIZE_URL" yaml:"login_authorize_url" toml:"login_authorize_url"`
+	LoginTokenURL     string        `env:"LOGIN_TOKEN_URL" yaml:"login_token_url" toml:"login_token_url"`
+	LoginClientID     string        `env:"LOGIN_CLIENT_ID" yaml:"login_client_id" toml:"login_client_id"`
+	LoginClientSecret string        `env:"LOGIN_CLIENT_SECRET" yaml:"login_client_secret" toml:"login_client_secret"`
+	LoginRedirectURL  string        `env:"LOGIN_REDIRECT_URL" yaml:"login_redirect_url" toml:"login_redirect_url"`
+	LoginScopes       []string      `env:"LOGIN_SCOPES" envSeparator:"," envDefault:"openid" yaml:"login_scopes" toml:"login_scopes"`
+	LoginCookieName   string        `env:"LOGIN_COOKIE_NAME" envDefault:"_tower_session" yaml:"login_cookie_name" toml:"login_cookie_name"`
+	LoginCookieDomain string        `env:"LOGIN_COOKIE_DOMAIN" yaml:"login_cookie_domain" toml:"login_cookie_domain"`
+	LoginCookieSecure bool          `env:"LOGIN_COOKIE_SECURE" envDefault:"true" yaml:"login_cookie_secure" toml:"login_cookie_secure"`
+	LoginCookieSecret string        `env:"LOGIN_COOKIE_SECRET" yaml:"login_cookie_secret" toml:"login_cookie_secret"`
+	LoginSessionTTL   time.Duration `env:"LOGIN_SESSION_TTL" envDefault:"8h" yaml:"login_session_ttl" toml:"login_session_ttl"`
+
+	// BruteForce blocks a client ip that sent bruteforce_max_failures invalid credentials within bruteforce_window,
+	// before they reach the identity provider. Repeated blocks double up to bruteforce_max_block. 0 disables it.
+	// Counters are shared by all tenants and kept across reloads, the settings are read at startup.
+	BruteForceMaxFailures int           `env:"BRUTEFORCE_MAX_FAILURES" envDefault:"0" yaml:"bruteforce_max_failures" toml:"bruteforce_max_failures"` // nolint: lll
+	BruteForceWindow      time.Duration `env:"BRUTEFORCE_WINDOW" envDefault:"1m" yaml:"bruteforce_window" toml:"bruteforce_window"`
+	BruteForceMaxBlock    time.Duration `env:"BRUTEFORCE_MAX_BLOCK" envDefault:"1h" yaml:"bruteforce_max_block" toml:"bruteforce_max_block"`
+
+	// AdminToken enables the /admin endpoints for requests with this bearer token, e.g. POST /admin/explain
+	// dry running a forward auth request. It applies to all tenants.
+	AdminToken string `env:"ADMIN_TOKEN" yaml:"admin_token" toml:"admin_token"`
+
+	// Headers names the response headers returned to the proxy
+	Headers *Headers `yaml:"headers" toml:"headers"`
+	// CognitoPools are the user pools accepted in cognito-aws mode in addition to cognito_user_pool_id,
+	// only configurable from the config file
+	CognitoPools []CognitoPool `yaml:"cognito_pools" toml:"cognito_pools"`
+	// Routes are only configurable from the config file
+	Routes route.Rules `yaml:"routes" toml:"routes"`
+	// Tenants are only configurable from the config file, requests matching no tenant use the top level config
+	Tenants []Tenant `yaml:"tenants" toml:"tenants"`
+
+	// Tenant is the name of the tenant profile applied by ForTenant
+	Tenant string `yaml:"-" toml:"-"`
+}
+
+type Headers struct {
+	ConsumerID  string `env:"HEADER_CONSUMER_ID" envDefault:"X-Consumer-Id" yaml:"consumer_id" toml:"consumer_id"`
+	Role        string `env:"HEADER_ROLE" envDefault:"" yaml:"role" toml:"role"`
+	CognitoPool string `env:"HEADER_COGNITO_POOL" envDefault:"X-Cognito-Pool" yaml:"cognito_pool" toml:"cognito_pool"`
+	Scopes      string `env:"HEADER_SCOPES" envDefault:"" yaml:"scopes" toml:"scopes"`
 }
 
+// IsAuthServiceURL reports whether the auth server is called over HTTP rather than through the AWS SDK
+// or a local store
 func (c *Config) IsAuthServiceURL() bool {
-	return c.CognitoAppClientID == "" && c.CognitoUserPoolID == ""
+	switch c.AuthType {
+	case AuthTypeCognitoAWS, AuthTypeAPIKey, AuthTypeMTLS, AuthTypeMTLSKeto, AuthTypeBasic, AuthTypeBasicKeto,
+		AuthTypeLDAP, AuthTypeLDAPKeto:
+		return false
+	}
+	return true
+}
+
+// IsKeto reports whether the auth type checks the request against ACP policies, in Keto or in process
+func (c *Config) IsKeto() bool {
+	switch c.AuthType {
+	case AuthTypeHydraKeto, AuthTypeKratosKeto, AuthTypeMTLSKeto, AuthTypeBasicKeto, AuthTypeLDAPKeto:
+		return true
+	}
+	return false
 }
 
 func (c *Config) IsAWSContext() bool {
@@ -29,7 +214,7 @@ func (c *Config) IsAWSContext() bool {
 }
 
 func FromEnv() (*Config, error) {
-	c := &Config{}
+	c := &Config{Headers: &Headers{}}
 	if err := env.Parse(c); err != nil {
 		return nil, err
 	}
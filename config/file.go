@@ -0,0 +1,101 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Load reads the config file at path, YAML or TOML by extension, and applies environment
+// variables on top of it. Without a path only the environment is used. The result is validated.
+func Load(path string) (*Config, error) {
+	c, err := FromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	if path != "" {
+		if err := c.decodeFile(path); err != nil {
+			return nil, fmt.Errorf("config file %s: %w", path, err)
+		}
+
+		// environment variables take precedence over the file
+		fromEnv, err := FromEnv()
+		if err != nil {
+			return nil, err
+		}
+		overrideFromEnv(reflect.ValueOf(c).Elem(), reflect.ValueOf(fromEnv).Elem())
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *Config) decodeFile(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		md, err := toml.Decode(string(b), c)
+		if err != nil {
+			return err
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			keys := make([]string, len(undecoded))
+			for i, k := range undecoded {
+				keys[i] = k.String()
+			}
+			return fmt.Errorf("unknown keys: %s", strings.Join(keys, ", "))
+		}
+	case ".yaml", ".yml", "":
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		dec.KnownFields(true)
+		if err := dec.Decode(c); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported config file extension %q", filepath.Ext(path))
+	}
+
+	if c.Headers == nil {
+		c.Headers = &Headers{}
+	}
+
+	return nil
+}
+
+// overrideFromEnv copies fields whose environment variable is set from src to dst
+func overrideFromEnv(dst, src reflect.Value) {
+	for i := 0; i < dst.NumField(); i++ {
+		field := dst.Type().Field(i)
+
+		if field.Type.Kind() == reflect.Ptr && field.Type.Elem().Kind() == reflect.Struct {
+			if dst.Field(i).IsNil() || src.Field(i).IsNil() {
+				continue
+			}
+			overrideFromEnv(dst.Field(i).Elem(), src.Field(i).Elem())
+			continue
+		}
+
+		key := strings.Split(field.Tag.Get("env"), ",")[0]
+		if key == "" {
+			continue
+		}
+		if _, ok := os.LookupEnv(key); ok {
+			dst.Field(i).Set(src.Field(i))
+		}
+	}
+}
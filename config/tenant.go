@@ -0,0 +1,126 @@
+package config
+
+import (
+	"fmt"
+
+	"traefik-tower/pkg/route"
+)
+
+// Tenant is a profile selected by X-Forwarded-Host or by the /t/{tenant} path on the tower.
+// Empty fields fall back to the top level config.
+type Tenant struct {
+	Name  string   `yaml:"name" toml:"name"`
+	Hosts []string `yaml:"hosts" toml:"hosts"`
+
+	AuthType           string   `yaml:"auth_type" toml:"auth_type"`
+	AuthServerURL      string   `yaml:"auth_server_url" toml:"auth_server_url"`
+	KetoURL            string   `yaml:"keto_url" toml:"keto_url"`
+	KetoResource       string   `yaml:"keto_resource" toml:"keto_resource"`
+	ACPPolicies        []string `yaml:"acp_policies" toml:"acp_policies"`
+	ACPFlavor          string   `yaml:"acp_flavor" toml:"acp_flavor"`
+	OPAURL             string   `yaml:"opa_url" toml:"opa_url"`
+	OPAPath            string   `yaml:"opa_path" toml:"opa_path"`
+	AwsRegion          string   `yaml:"aws_region" toml:"aws_region"`
+	AwsProfile         string   `yaml:"aws_profile" toml:"aws_profile"`
+	CognitoAppClientID string   `yaml:"cognito_app_client_id" toml:"cognito_app_client_id"`
+	CognitoUserPoolID  string   `yaml:"cognito_user_pool_id" toml:"cognito_user_pool_id"`
+
+	CognitoPools []CognitoPool `yaml:"cognito_pools" toml:"cognito_pools"`
+	Headers      *Headers      `yaml:"headers" toml:"headers"`
+	Routes       route.Rules   `yaml:"routes" toml:"routes"`
+}
+
+// ForTenant returns a copy of the config with the tenant profile applied
+func (c *Config) ForTenant(t *Tenant) *Config {
+	tc := *c
+	tc.Tenant = t.Name
+	tc.Tenants = nil
+
+	override := func(dst *string, v string) {
+		if v != "" {
+			*dst = v
+		}
+	}
+
+	// backends belong to the tenant, a tenant of another auth type does not inherit them
+	if t.AuthType != "" && t.AuthType != c.AuthType {
+		tc.AuthServerURL, tc.KetoURL, tc.KetoResource = "", "", ""
+		tc.CognitoAppClientID, tc.CognitoUserPoolID = "", ""
+		tc.CognitoPools = nil
+		tc.ACPPolicies = nil
+	}
+
+	override(&tc.AuthType, t.AuthType)
+	override(&tc.AuthServerURL, t.AuthServerURL)
+	override(&tc.KetoURL, t.KetoURL)
+	override(&tc.KetoResource, t.KetoResource)
+	override(&tc.AwsRegion, t.AwsRegion)
+	override(&tc.AwsProfile, t.AwsProfile)
+	override(&tc.CognitoAppClientID, t.CognitoAppClientID)
+	override(&tc.CognitoUserPoolID, t.CognitoUserPoolID)
+	override(&tc.ACPFlavor, t.ACPFlavor)
+	override(&tc.OPAURL, t.OPAURL)
+	override(&tc.OPAPath, t.OPAPath)
+
+	if t.CognitoPools != nil {
+		tc.CognitoPools = t.CognitoPools
+	}
+	if t.ACPPolicies != nil {
+		tc.ACPPolicies = t.ACPPolicies
+		// a tenant using its own policies does not inherit keto
+		if t.KetoURL == "" {
+			tc.KetoURL = ""
+		}
+	}
+
+	if t.Headers != nil {
+		h := *c.Headers
+		override(&h.ConsumerID, t.Headers.ConsumerID)
+		override(&h.Role, t.Headers.Role)
+		override(&h.CognitoPool, t.Headers.CognitoPool)
+		override(&h.Scopes, t.Headers.Scopes)
+		tc.Headers = &h
+	}
+
+	if t.Routes != nil {
+		tc.Routes = t.Routes
+	}
+
+	return &tc
+}
+
+func (c *Config) validateTenants() []string {
+	var problems []string
+
+	names := map[string]bool{}
+	for i := range c.Tenants {
+		t := &c.Tenants[i]
+
+		prefix := fmt.Sprintf("tenants[%d]", i)
+		if t.Name == "" {
+			problems = append(problems, prefix+".name: must be set")
+		} else {
+			prefix = fmt.Sprintf("tenants[%s]", t.Name)
+			if names[t.Name] {
+				problems = append(problems, prefix+": duplicate tenant name")
+			}
+			names[t.Name] = true
+		}
+
+		for _, h := range t.Hosts {
+			if !validHostPattern(h) {
+				problems = append(problems, fmt.Sprintf("%s.hosts: %q must be a host or *.domain wildcard", prefix, h))
+			}
+		}
+
+		tc := c.ForTenant(t)
+		for _, p := range append(tc.validateAuthType(), tc.validateRoutes()...) {
+			problems = append(problems, prefix+"."+p)
+		}
+		if tc.Headers.ConsumerID == "" {
+			problems = append(problems, prefix+".headers.consumer_id: must be set")
+		}
+	}
+
+	return problems
+}
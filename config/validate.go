@@ -0,0 +1,425 @@
+package config
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"traefik-tower/pkg/acp"
+	"traefik-tower/pkg/forward"
+	"traefik-tower/pkg/mtls"
+	"traefik-tower/pkg/route"
+)
+
+// ValidationError lists every problem found in the configuration
+type ValidationError []string
+
+func (e ValidationError) Error() string {
+	return "invalid config:\n  - " + strings.Join(e, "\n  - ")
+}
+
+var httpMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodConnect: true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+}
+
+// Validate checks the whole configuration and reports all problems at once
+func (c *Config) Validate() error {
+	var problems ValidationError
+
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if p, err := strconv.Atoi(c.Port); err != nil || p < 1 || p > 65535 {
+		add("port: %q is not a valid port", c.Port)
+	}
+
+	if c.ExtAuthzPort != "" {
+		if p, err := strconv.Atoi(c.ExtAuthzPort); err != nil || p < 1 || p > 65535 {
+			add("ext_authz_port: %q is not a valid port", c.ExtAuthzPort)
+		} else if c.ExtAuthzPort == c.Port {
+			add("ext_authz_port: must differ from port")
+		}
+	}
+	if (c.ExtAuthzTLSCertFile == "") != (c.ExtAuthzTLSKeyFile == "") {
+		add("ext_authz_tls_cert_file, ext_authz_tls_key_file: set both or neither")
+	}
+	if c.ExtAuthzTLSClientCAFile != "" && c.ExtAuthzTLSCertFile == "" {
+		add("ext_authz_tls_client_ca_file: requires ext_authz_tls_cert_file and ext_authz_tls_key_file")
+	}
+
+	for _, p := range c.TrustedProxies {
+		if _, err := forward.ParseCIDR(p); err != nil {
+			add("trusted_proxies: %v", err)
+		}
+	}
+
+	problems = append(problems, c.validateAuthType()...)
+
+	switch c.TracingExporter {
+	case "otlp", "none":
+	default:
+		add("tracing_exporter: must be one of otlp, none, got %q", c.TracingExporter)
+	}
+
+	if c.AccessLogSampleRate < 0 || c.AccessLogSampleRate > 1 {
+		add("access_log_sample_rate: must be between 0 and 1, got %v", c.AccessLogSampleRate)
+	}
+
+	if c.Audit {
+		switch c.AuditSink {
+		case "file":
+			if c.AuditFile == "" {
+				add("audit_file: required when audit_sink is file")
+			}
+		case "webhook":
+			if c.AuditWebhookURL == "" {
+				add("audit_webhook_url: required when audit_sink is webhook")
+			}
+			if c.AuditWebhookSpool == "" {
+				add("audit_webhook_spool: required when audit_sink is webhook")
+			}
+		default:
+			add("audit_sink: must be one of file, webhook, got %q", c.AuditSink)
+		}
+	}
+
+	if c.KratosCacheSize < 0 {
+		add("kratos_cache_size: must not be negative")
+	}
+	for trait, header := range c.KratosTraitHeaders {
+		if trait == "" || header == "" {
+			add("kratos_trait_headers: trait and header names must be set")
+		}
+	}
+
+	if c.Login {
+		problems = append(problems, c.validateLogin()...)
+	}
+
+	if c.BruteForceMaxFailures < 0 {
+		add("bruteforce_max_failures: must not be negative")
+	}
+	if c.BruteForceMaxFailures > 0 && (c.BruteForceWindow <= 0 || c.BruteForceMaxBlock <= 0) {
+		add("bruteforce_window, bruteforce_max_block: must be positive")
+	}
+	if c.BruteForceMaxFailures > 0 && len(c.TrustedProxies) == 0 {
+		add("trusted_proxies: required when bruteforce_max_failures is set, client ips are only read from them")
+	}
+
+	if c.AdminToken != "" && len(c.AdminToken) < MinAdminTokenLen {
+		add("admin_token: must be at least %d characters", MinAdminTokenLen)
+	}
+
+	if c.Headers == nil || c.Headers.ConsumerID == "" {
+		add("headers.consumer_id: must be set")
+	}
+
+	problems = append(problems, c.validateRoutes()...)
+	problems = append(problems, c.validateTenants()...)
+
+	if len(problems) > 0 {
+		return problems
+	}
+
+	return nil
+}
+
+func isHTTPURL(value string) bool {
+	u, err := url.Parse(value)
+	return err == nil && u.Hostname() != "" && (u.Scheme == "http" || u.Scheme == "https")
+}
+
+// validateAuthType checks the settings each auth type requires and the ones that would
+// silently switch it to another backend
+func (c *Config) validateAuthType() []string {
+	var problems []string
+
+	required := func(key, value string) {
+		if value == "" {
+			problems = append(problems, fmt.Sprintf("%s: required when auth_type is %s", key, c.AuthType))
+		}
+	}
+	validURL := func(key, value string) {
+		if value == "" {
+			return
+		}
+		if !isHTTPURL(value) {
+			problems = append(problems, fmt.Sprintf("%s: %q must be an http(s) url", key, value))
+		}
+	}
+	conflicts := func(key, value string) {
+		if value != "" {
+			problems = append(problems, fmt.Sprintf("%s: cannot be used with auth_type %s", key, c.AuthType))
+		}
+	}
+
+	switch c.AuthType {
+	case AuthTypeHydra, AuthTypeCognito, AuthTypeHydraKeto, AuthTypeKratos, AuthTypeKratosKeto:
+		required("auth_server_url", c.AuthServerURL)
+		conflicts("cognito_user_pool_id", c.CognitoUserPoolID)
+		conflicts("cognito_app_client_id", c.CognitoAppClientID)
+		if len(c.CognitoPools) > 0 {
+			conflicts("cognito_pools", "set")
+		}
+	case AuthTypeCognitoAWS:
+		if len(c.CognitoUserPools()) == 0 {
+			problems = append(problems, "cognito_user_pool_id: required when auth_type is cognito-aws unless cognito_pools is set")
+		}
+		if c.CognitoAppClientID != "" && c.CognitoUserPoolID == "" {
+			problems = append(problems, "cognito_user_pool_id: required with cognito_app_client_id")
+		}
+		problems = append(problems, c.validateCognitoPools()...)
+		conflicts("auth_server_url", c.AuthServerURL)
+	case AuthTypeMTLS, AuthTypeMTLSKeto:
+		if len(c.MTLSCAFiles) == 0 {
+			problems = append(problems, fmt.Sprintf("mtls_ca_files: required when auth_type is %s", c.AuthType))
+		}
+		if !contains(mtls.IDSources, c.MTLSConsumerID) {
+			problems = append(problems, fmt.Sprintf("mtls_consumer_id: must be one of %s, got %q",
+				strings.Join(mtls.IDSources, ", "), c.MTLSConsumerID))
+		}
+		if len(c.TrustedProxies) == 0 {
+			problems = append(problems, fmt.Sprintf("trusted_proxies: required when auth_type is %s, client certificates are only read from them", c.AuthType))
+		}
+		conflicts("auth_server_url", c.AuthServerURL)
+		conflicts("cognito_user_pool_id", c.CognitoUserPoolID)
+	case AuthTypeAPIKey:
+		required("api_key_file", c.APIKeyFile)
+		if c.APIKeyHeader == "" && c.APIKeyQueryParam == "" {
+			problems = append(problems, "api_key_header: required when auth_type is api-key unless api_key_query_param is set")
+		}
+		conflicts("auth_server_url", c.AuthServerURL)
+		conflicts("cognito_user_pool_id", c.CognitoUserPoolID)
+	case AuthTypeBasic, AuthTypeBasicKeto:
+		required("basic_auth_file", c.BasicAuthFile)
+		problems = append(problems, c.validateBasicThrottle()...)
+		conflicts("auth_server_url", c.AuthServerURL)
+		conflicts("cognito_user_pool_id", c.CognitoUserPoolID)
+	case AuthTypeLDAP, AuthTypeLDAPKeto:
+		problems = append(problems, c.validateLDAP()...)
+		problems = append(problems, c.validateBasicThrottle()...)
+		conflicts("auth_server_url", c.AuthServerURL)
+		conflicts("cognito_user_pool_id", c.CognitoUserPoolID)
+	default:
+		return []string{fmt.Sprintf("auth_type: must be one of %s, got %q", strings.Join(AuthTypes, ", "), c.AuthType)}
+	}
+
+	switch {
+	case c.IsKeto() && len(c.ACPPolicies) > 0:
+		if c.KetoURL != "" {
+			problems = append(problems, "keto_url: cannot be used with acp_policies")
+		}
+	case c.IsKeto():
+		required("keto_url", c.KetoURL)
+	case len(c.ACPPolicies) > 0:
+		conflicts("acp_policies", "set")
+	}
+	if len(c.ACPPolicies) > 0 && !contains(acp.Flavors, c.ACPFlavor) {
+		problems = append(problems, fmt.Sprintf("acp_flavor: must be one of %s, got %q", strings.Join(acp.Flavors, ", "), c.ACPFlavor))
+	}
+
+	if c.OPAURL != "" && strings.Trim(c.OPAPath, "/") == "" {
+		problems = append(problems, "opa_path: required with opa_url")
+	}
+
+	validURL("auth_server_url", c.AuthServerURL)
+	validURL("keto_url", c.KetoURL)
+	validURL("opa_url", c.OPAURL)
+
+	return problems
+}
+
+func (c *Config) validateLDAP() []string {
+	var problems []string
+
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if c.LDAPURL == "" {
+		add("ldap_url: required when auth_type is %s", c.AuthType)
+	} else if u, err := url.Parse(c.LDAPURL); err != nil || u.Hostname() == "" || (u.Scheme != "ldap" && u.Scheme != "ldaps") {
+		add("ldap_url: %q must be an ldap:// or ldaps:// url", c.LDAPURL)
+	} else if u.Scheme == "ldaps" && c.LDAPStartTLS {
+		add("ldap_start_tls: cannot be used with an ldaps:// url")
+	}
+	if c.LDAPBaseDN == "" {
+		add("ldap_base_dn: required when auth_type is %s", c.AuthType)
+	}
+	if !strings.Contains(c.LDAPUserFilter, "%s") {
+		add("ldap_user_filter: must contain %%s for the user name, got %q", c.LDAPUserFilter)
+	}
+	if c.LDAPBindDN != "" && c.LDAPBindPassword == "" {
+		add("ldap_bind_password: required with ldap_bind_dn")
+	}
+	if c.LDAPGroupFilter != "" {
+		if c.LDAPGroupBaseDN == "" {
+			add("ldap_group_base_dn: required with ldap_group_filter")
+		}
+		if c.LDAPGroupNameAttribute == "" {
+			add("ldap_group_name_attribute: required with ldap_group_filter")
+		}
+	}
+	if c.LDAPPoolSize < 1 {
+		add("ldap_pool_size: must be at least 1")
+	}
+	if c.LDAPTimeout <= 0 {
+		add("ldap_timeout: must be positive")
+	}
+	if c.LDAPCacheTTL < 0 || c.LDAPCacheSize < 0 {
+		add("ldap_cache_ttl, ldap_cache_size: must not be negative")
+	}
+
+	return problems
+}
+
+// validateBasicThrottle checks the failed attempt throttling shared by the basic credential backends
+func (c *Config) validateBasicThrottle() []string {
+	if c.BasicAuthMaxFailures < 0 {
+		return []string{"basic_auth_max_failures: must not be negative"}
+	}
+	if c.BasicAuthMaxFailures > 0 && c.BasicAuthFailureWindow <= 0 {
+		return []string{"basic_auth_failure_window: must be positive when basic_auth_max_failures is set"}
+	}
+
+	return nil
+}
+
+func (c *Config) validateRoutes() []string {
+	var problems []string
+
+	names := map[string]bool{}
+	for i, r := range c.Routes {
+		prefix := fmt.Sprintf("routes[%d]", i)
+		if r.Name == "" {
+			problems = append(problems, prefix+".name: must be set")
+		} else {
+			prefix = fmt.Sprintf("routes[%s]", r.Name)
+			if names[r.Name] {
+				problems = append(problems, prefix+": duplicate route name")
+			}
+			names[r.Name] = true
+		}
+
+		if r.PathPrefix != "" && !strings.HasPrefix(r.PathPrefix, "/") {
+			problems = append(problems, fmt.Sprintf("%s.path_prefix: must start with /, got %q", prefix, r.PathPrefix))
+		}
+
+		for _, m := range r.Methods {
+			if !httpMethods[strings.ToUpper(m)] {
+				problems = append(problems, fmt.Sprintf("%s.methods: unknown method %q", prefix, m))
+			}
+		}
+
+		for _, h := range r.Hosts {
+			if !validHostPattern(h) {
+				problems = append(problems, fmt.Sprintf("%s.hosts: %q must be a host or *.domain wildcard", prefix, h))
+			}
+		}
+
+		if r.Public && len(r.Roles) > 0 {
+			problems = append(problems, prefix+": public routes cannot require roles")
+		}
+
+		for _, f := range []struct {
+			name  string
+			cidrs []string
+		}{{"deny_cidrs", r.DenyCIDRs}, {"allow_cidrs", r.AllowCIDRs}, {"public_cidrs", r.PublicCIDRs}} {
+			for _, c := range f.cidrs {
+				if _, err := forward.ParseCIDR(c); err != nil {
+					problems = append(problems, fmt.Sprintf("%s.%s: %v", prefix, f.name, err))
+				}
+			}
+		}
+		if r.Public && len(r.PublicCIDRs) > 0 {
+			problems = append(problems, prefix+": public routes need no public_cidrs")
+		}
+		if r.HasCIDRs() && len(c.TrustedProxies) == 0 {
+			problems = append(problems, prefix+": trusted_proxies are required with deny_cidrs, allow_cidrs or public_cidrs")
+		}
+
+		if rl := r.RateLimit; rl != nil {
+			if rl.Requests <= 0 || rl.Per <= 0 {
+				problems = append(problems, prefix+".rate_limit: requests and per must be positive")
+			}
+			if rl.Burst < 0 {
+				problems = append(problems, prefix+".rate_limit.burst: must not be negative")
+			}
+			keys := []string{route.RateLimitKeyConsumer, route.RateLimitKeyRole, route.RateLimitKeyClientIP}
+			if rl.Key != "" && !contains(keys, rl.Key) {
+				problems = append(problems, fmt.Sprintf("%s.rate_limit.key: must be one of %s, got %q", prefix, strings.Join(keys, ", "), rl.Key))
+			}
+		}
+	}
+
+	return problems
+}
+
+func validHostPattern(h string) bool {
+	if h == "" || strings.Contains(h[1:], "*") {
+		return false
+	}
+
+	return !strings.HasPrefix(h, "*") || strings.HasPrefix(h, "*.")
+}
+
+// MinAdminTokenLen keeps the admin token from being guessable
+const MinAdminTokenLen = 32
+
+// MinLoginCookieSecretLen keeps the session cookie key from being guessable
+const MinLoginCookieSecretLen = 32
+
+func (c *Config) validateLogin() []string {
+	var problems []string
+
+	urls := []struct {
+		name, value string
+	}{
+		{"login_authorize_url", c.LoginAuthorizeURL},
+		{"login_token_url", c.LoginTokenURL},
+		{"login_redirect_url", c.LoginRedirectURL},
+	}
+	for _, u := range urls {
+		if u.value == "" {
+			problems = append(problems, u.name+": required when login is enabled")
+		} else if !isHTTPURL(u.value) {
+			problems = append(problems, fmt.Sprintf("%s: %q must be an http(s) url", u.name, u.value))
+		}
+	}
+
+	if c.LoginClientID == "" {
+		problems = append(problems, "login_client_id: required when login is enabled")
+	}
+	if len(c.LoginCookieSecret) < MinLoginCookieSecretLen {
+		problems = append(problems, fmt.Sprintf("login_cookie_secret: must be at least %d characters", MinLoginCookieSecretLen))
+	}
+	if c.LoginCookieName == "" {
+		problems = append(problems, "login_cookie_name: must be set")
+	}
+	if c.LoginSessionTTL <= 0 {
+		problems = append(problems, "login_session_ttl: must be positive")
+	}
+
+	return problems
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
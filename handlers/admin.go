@@ -0,0 +1,224 @@
+package handlers
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/log"
+
+	"traefik-tower/pkg/decision"
+	"traefik-tower/pkg/forward"
+	"traefik-tower/pkg/throttle"
+	"traefik-tower/services"
+)
+
+// ErrUnknownTenant is returned when an explained request names a tenant that is not configured
+var ErrUnknownTenant = errors.New("unknown tenant")
+
+// PathVarClientIP is the mux variable holding the client ip in /admin/blocks/{ip}
+const PathVarClientIP = "ip"
+
+// Admin serves the /admin endpoints, requests need the admin token as bearer token
+type Admin struct {
+	token   string
+	tenants *TenantRouter
+	blocks  *throttle.Limiter
+}
+
+func NewAdmin(token string, tenants *TenantRouter, blocks *throttle.Limiter) *Admin {
+	return &Admin{token: token, tenants: tenants, blocks: blocks}
+}
+
+// Auth rejects requests without the admin token
+func (a *Admin) Auth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		token := strings.TrimPrefix(req.Header.Get("Authorization"), services.AuthBearer+" ")
+		if a.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		next(w, req)
+	}
+}
+
+// Explain dry runs the forward auth request in the body and returns every stage of the decision
+func (a *Admin) Explain(w http.ResponseWriter, req *http.Request) {
+	var er ExplainRequest
+	if err := json.NewDecoder(req.Body).Decode(&er); err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if er.URI == "" || !strings.HasPrefix(er.URI, "/") {
+		http.Error(w, "invalid request: uri must start with /", http.StatusBadRequest)
+		return
+	}
+
+	resp, err := a.tenants.Explain(req.Context(), &er)
+	if err == ErrUnknownTenant {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Blocks lists the client ips blocked for sending invalid credentials
+func (a *Admin) Blocks(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(a.blocks.BlockedKeys()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Unblock lifts the block of a client ip
+func (a *Admin) Unblock(w http.ResponseWriter, req *http.Request) {
+	ip := mux.Vars(req)[PathVarClientIP]
+	if !a.blocks.Unblock(ip) {
+		http.Error(w, "not blocked", http.StatusNotFound)
+		return
+	}
+
+	log.Info().Str("client_ip", ip).Msg("client unblocked")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ExplainRequest is a forward auth request to dry run
+type ExplainRequest struct {
+	// Token is sent as bearer token
+	Token  string `json:"token"`
+	Method string `json:"method"`
+	Host   string `json:"host"`
+	URI    string `json:"uri"`
+	// ClientIP is the forwarded client ip
+	ClientIP string `json:"client_ip"`
+	// Tenant selects a tenant by name instead of by host
+	Tenant string `json:"tenant"`
+	// Headers are sent along, e.g. X-Api-Key, a session cookie or basic auth
+	Headers map[string]string `json:"headers"`
+}
+
+// ExplainResponse is the decision of a dry run with the inputs and outputs of its stages
+type ExplainResponse struct {
+	Tenant     string           `json:"tenant,omitempty"`
+	AuthType   string           `json:"auth_type"`
+	Route      string           `json:"route"`
+	Steps      []decision.Step  `json:"steps"`
+	Outcome    decision.Outcome `json:"outcome"`
+	Reason     string           `json:"reason"`
+	Status     int              `json:"status"`
+	ConsumerID string           `json:"consumer_id,omitempty"`
+	Roles      []string         `json:"roles,omitempty"`
+	// Headers are the response headers returned to the proxy
+	Headers map[string]string `json:"headers,omitempty"`
+	// Error is the internal error of a failed decision
+	Error string `json:"error,omitempty"`
+}
+
+// Explain runs er through the tenant handler the proxy request would reach. Caches, failure counters,
+// metrics, the access log and the audit log are left alone.
+func (tr *TenantRouter) Explain(ctx context.Context, er *ExplainRequest) (*ExplainResponse, error) {
+	h := http.Handler(tr)
+	if er.Tenant != "" {
+		var ok bool
+		if h, ok = tr.byName[er.Tenant]; !ok {
+			return nil, ErrUnknownTenant
+		}
+	}
+
+	method := strings.ToUpper(er.Method)
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	ex := &decision.Explain{}
+	ctx = decision.NewExplainContext(ctx, ex)
+	ctx = forward.NewContext(ctx, &forward.Request{
+		Method:   method,
+		Host:     er.Host,
+		URI:      er.URI,
+		Proto:    "https",
+		ClientIP: er.ClientIP,
+	})
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "/", nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range er.Headers {
+		req.Header.Set(name, value)
+	}
+	if er.Token != "" {
+		req.Header.Set("Authorization", services.AuthBearer+" "+er.Token)
+	}
+
+	w := &explainWriter{header: http.Header{}}
+	h.ServeHTTP(w, req)
+
+	rec := ex.Record
+	if rec == nil {
+		return nil, fmt.Errorf("no auth handler ran, status %d", w.status)
+	}
+
+	resp := &ExplainResponse{
+		Tenant:     rec.Tenant,
+		AuthType:   rec.AuthType,
+		Route:      rec.Route,
+		Steps:      ex.Steps,
+		Outcome:    rec.Outcome,
+		Reason:     rec.Reason,
+		Status:     w.status,
+		ConsumerID: rec.ConsumerID,
+		Roles:      rec.Roles,
+		Headers:    map[string]string{},
+	}
+	if resp.Steps == nil {
+		resp.Steps = []decision.Step{}
+	}
+	for name := range w.header {
+		if name != "Content-Type" {
+			resp.Headers[name] = w.header.Get(name)
+		}
+	}
+	if rec.Outcome == decision.OutcomeError {
+		resp.Error = ex.Error
+	}
+
+	return resp, nil
+}
+
+// explainWriter keeps the status and headers of a dry run
+type explainWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *explainWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *explainWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return len(b), nil
+}
+
+func (w *explainWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
@@ -1,49 +1,76 @@
 package handlers
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"math"
 	"net/http"
-	"net/http/httputil"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/rs/zerolog/log"
 
 	"traefik-tower/config"
+	"traefik-tower/pkg/accesslog"
+	"traefik-tower/pkg/audit"
+	"traefik-tower/pkg/decision"
+	"traefik-tower/pkg/forward"
+	"traefik-tower/pkg/metrics"
+	"traefik-tower/pkg/redact"
+	"traefik-tower/pkg/route"
+	"traefik-tower/pkg/tracer"
 	"traefik-tower/services"
 )
 
+const HeaderXRequestID = "X-Request-Id"
+
 type Handlers struct {
 	cfg       *config.Config
 	srv       *services.Service
-	startTime time.Time
+	accessLog *accesslog.Logger
+	auditor   *audit.Auditor
 }
 
-func NewHandlers(cfg *config.Config, srv *services.Service) *Handlers {
+func NewHandlers(cfg *config.Config, srv *services.Service, accessLog *accesslog.Logger, auditor *audit.Auditor) *Handlers {
 	return &Handlers{
 		cfg:       cfg,
 		srv:       srv,
-		startTime: time.Now(),
+		accessLog: accessLog,
+		auditor:   auditor,
 	}
 }
 
 // Hydra Introspect
 func (h *Handlers) Hydra(w http.ResponseWriter, req *http.Request) {
-	defer h.srv.Tracer.Finish()
+	req, rec := h.begin(req, config.AuthTypeHydra)
+	defer h.srv.Tracer.Finish(req)
+	defer h.finish(req, rec)
+	if h.public(w, req) || h.blocked(w, req) {
+		return
+	}
+
 	id, err := h.srv.HydraIntrospect(req)
 	if err != nil {
 		h.cError(w, req, err)
 		return
 	}
 
-	w.Header().Set("X-Consumer-Id", id.ToString())
-	h.jsonResponse(w, req, http.StatusOK, http.StatusText(http.StatusOK))
+	h.allow(w, req, id.ToString())
 }
 
 // HydraKeto Introspect
 func (h *Handlers) HydraKeto(w http.ResponseWriter, req *http.Request) {
-	defer h.srv.Tracer.Finish()
+	req, rec := h.begin(req, config.AuthTypeHydraKeto)
+	defer h.srv.Tracer.Finish(req)
+	defer h.finish(req, rec)
+	if h.public(w, req) || h.blocked(w, req) {
+		return
+	}
+
 	// check hydra token
 	cID, err := h.srv.HydraIntrospect(req)
 	if err != nil {
@@ -65,39 +92,276 @@ func (h *Handlers) HydraKeto(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	w.Header().Set("X-Consumer-Id", cID.ToString())
-	h.jsonResponse(w, req, http.StatusOK, http.StatusText(http.StatusOK))
+	h.allow(w, req, cID.ToString())
 }
 
 // Cognito auth
 func (h *Handlers) Cognito(w http.ResponseWriter, req *http.Request) {
-	defer h.srv.Tracer.Finish()
+	req, rec := h.begin(req, config.AuthTypeCognito)
+	defer h.srv.Tracer.Finish(req)
+	defer h.finish(req, rec)
+	if h.public(w, req) || h.blocked(w, req) {
+		return
+	}
+
 	id, err := h.srv.CognitoUserInfo(req)
 	if err != nil {
 		h.cError(w, req, err)
 		return
 	}
 
-	w.Header().Set("X-Consumer-Id", id.ToString())
-	h.jsonResponse(w, req, http.StatusOK, http.StatusText(http.StatusOK))
+	h.allow(w, req, id.ToString())
 }
 
 // Cognito AWS auth
 func (h *Handlers) CognitoAWS(w http.ResponseWriter, req *http.Request) {
-	defer h.srv.Tracer.Finish()
+	req, rec := h.begin(req, config.AuthTypeCognitoAWS)
+	defer h.srv.Tracer.Finish(req)
+	defer h.finish(req, rec)
+	if h.public(w, req) || h.blocked(w, req) {
+		return
+	}
+
 	id, err := h.srv.CognitoAWSUserInfo(req)
 	if err != nil {
 		h.cError(w, req, err)
 		return
 	}
 
-	w.Header().Set("X-Consumer-Id", id.ToString())
-	h.jsonResponse(w, req, http.StatusOK, http.StatusText(http.StatusOK))
+	h.allow(w, req, id.ToString())
+}
+
+// Kratos session auth
+func (h *Handlers) Kratos(w http.ResponseWriter, req *http.Request) {
+	req, rec := h.begin(req, config.AuthTypeKratos)
+	defer h.srv.Tracer.Finish(req)
+	defer h.finish(req, rec)
+	if h.public(w, req) || h.blocked(w, req) {
+		return
+	}
+
+	ks, err := h.srv.KratosWhoami(req)
+	if err != nil {
+		h.cError(w, req, err)
+		return
+	}
+
+	h.allowHeaders(w, req, ks.Identity.ID, h.traitHeaders(ks))
+}
+
+// KratosKeto Kratos session auth checked against keto, the subject is the role trait or the identity id
+func (h *Handlers) KratosKeto(w http.ResponseWriter, req *http.Request) {
+	req, rec := h.begin(req, config.AuthTypeKratosKeto)
+	defer h.srv.Tracer.Finish(req)
+	defer h.finish(req, rec)
+	if h.public(w, req) || h.blocked(w, req) {
+		return
+	}
+
+	ks, err := h.srv.KratosWhoami(req)
+	if err != nil {
+		h.cError(w, req, err)
+		return
+	}
+
+	subject := ks.Identity.ID
+	if rec.Role != "" {
+		subject = rec.Role
+	}
+
+	err = h.srv.HydraKetoAllowed(req, subject)
+	if err != nil {
+		h.cError(w, req, err)
+		return
+	}
+
+	h.allowHeaders(w, req, ks.Identity.ID, h.traitHeaders(ks))
+}
+
+// APIKey auth, the consumer is the key owner
+func (h *Handlers) APIKey(w http.ResponseWriter, req *http.Request) {
+	req, rec := h.begin(req, config.AuthTypeAPIKey)
+	defer h.srv.Tracer.Finish(req)
+	defer h.finish(req, rec)
+	if h.public(w, req) || h.blocked(w, req) {
+		return
+	}
+
+	key, err := h.srv.APIKey(req)
+	if err != nil {
+		h.cError(w, req, err)
+		return
+	}
+
+	headers := map[string]string{}
+	if h.cfg.Headers.Scopes != "" && len(key.Scopes) > 0 {
+		headers[h.cfg.Headers.Scopes] = strings.Join(key.Scopes, " ")
+	}
+
+	h.allowHeaders(w, req, key.Owner, headers)
+}
+
+// MTLS client certificate auth
+func (h *Handlers) MTLS(w http.ResponseWriter, req *http.Request) {
+	req, rec := h.begin(req, config.AuthTypeMTLS)
+	defer h.srv.Tracer.Finish(req)
+	defer h.finish(req, rec)
+	if h.public(w, req) || h.blocked(w, req) {
+		return
+	}
+
+	id, err := h.srv.MTLSClient(req)
+	if err != nil {
+		h.cError(w, req, err)
+		return
+	}
+
+	h.allow(w, req, id.ToString())
+}
+
+// MTLSKeto client certificate auth checked against keto with the consumer id as subject
+func (h *Handlers) MTLSKeto(w http.ResponseWriter, req *http.Request) {
+	req, rec := h.begin(req, config.AuthTypeMTLSKeto)
+	defer h.srv.Tracer.Finish(req)
+	defer h.finish(req, rec)
+	if h.public(w, req) || h.blocked(w, req) {
+		return
+	}
+
+	id, err := h.srv.MTLSClient(req)
+	if err != nil {
+		h.cError(w, req, err)
+		return
+	}
+
+	err = h.srv.HydraKetoAllowed(req, id.ToString())
+	if err != nil {
+		h.cError(w, req, err)
+		return
+	}
+
+	h.allow(w, req, id.ToString())
+}
+
+// Basic auth against the htpasswd file
+func (h *Handlers) Basic(w http.ResponseWriter, req *http.Request) {
+	req, rec := h.begin(req, config.AuthTypeBasic)
+	defer h.srv.Tracer.Finish(req)
+	defer h.finish(req, rec)
+	if h.public(w, req) || h.blocked(w, req) {
+		return
+	}
+
+	id, err := h.srv.BasicAuth(req)
+	if err != nil {
+		h.basicError(w, req, err)
+		return
+	}
+
+	h.allow(w, req, id.ToString())
+}
+
+// BasicKeto basic auth checked against keto with the user as subject
+func (h *Handlers) BasicKeto(w http.ResponseWriter, req *http.Request) {
+	req, rec := h.begin(req, config.AuthTypeBasicKeto)
+	defer h.srv.Tracer.Finish(req)
+	defer h.finish(req, rec)
+	if h.public(w, req) || h.blocked(w, req) {
+		return
+	}
+
+	id, err := h.srv.BasicAuth(req)
+	if err != nil {
+		h.basicError(w, req, err)
+		return
+	}
+
+	err = h.srv.HydraKetoAllowed(req, id.ToString())
+	if err != nil {
+		h.cError(w, req, err)
+		return
+	}
+
+	h.allow(w, req, id.ToString())
+}
+
+// LDAP bind auth with basic credentials
+func (h *Handlers) LDAP(w http.ResponseWriter, req *http.Request) {
+	req, rec := h.begin(req, config.AuthTypeLDAP)
+	defer h.srv.Tracer.Finish(req)
+	defer h.finish(req, rec)
+	if h.public(w, req) || h.blocked(w, req) {
+		return
+	}
+
+	id, err := h.srv.LDAPAuth(req)
+	if err != nil {
+		h.basicError(w, req, err)
+		return
+	}
+
+	h.allow(w, req, id.ToString())
+}
+
+// LDAPKeto LDAP bind auth checked against keto with the user as subject
+func (h *Handlers) LDAPKeto(w http.ResponseWriter, req *http.Request) {
+	req, rec := h.begin(req, config.AuthTypeLDAPKeto)
+	defer h.srv.Tracer.Finish(req)
+	defer h.finish(req, rec)
+	if h.public(w, req) || h.blocked(w, req) {
+		return
+	}
+
+	id, err := h.srv.LDAPAuth(req)
+	if err != nil {
+		h.basicError(w, req, err)
+		return
+	}
+
+	err = h.srv.HydraKetoAllowed(req, id.ToString())
+	if err != nil {
+		h.cError(w, req, err)
+		return
+	}
+
+	h.allow(w, req, id.ToString())
+}
+
+// basicError asks the browser for credentials again unless the user is throttled
+func (h *Handlers) basicError(w http.ResponseWriter, req *http.Request, err error) {
+	switch err {
+	case services.ErrUnauthorized:
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", h.cfg.BasicAuthRealm))
+	case services.ErrTooManyRequests:
+		w.Header().Set("Retry-After", seconds(h.srv.BasicRetryAfter(req)))
+	}
+
+	h.cError(w, req, err)
+}
+
+// traitHeaders maps the configured identity traits to response headers, objects are JSON encoded
+func (h *Handlers) traitHeaders(ks *services.KratosSession) map[string]string {
+	headers := map[string]string{}
+	for trait, header := range h.cfg.KratosTraitHeaders {
+		switch v := ks.Identity.Traits[trait].(type) {
+		case nil:
+		case string:
+			headers[header] = v
+		case bool, float64:
+			headers[header] = fmt.Sprint(v)
+		default:
+			if b, err := json.Marshal(v); err == nil {
+				headers[header] = string(b)
+			}
+		}
+	}
+
+	return headers
 }
 
 // AlwaysSuccess
 func (h *Handlers) AlwaysSuccess(w http.ResponseWriter, req *http.Request) {
-	r, err := httputil.DumpRequest(req, true)
+	r, err := redact.DumpRequest(req, true)
 	if err != nil {
 		log.Fatal().Err(err).Msg("httputil.DumpRequest error")
 	}
@@ -118,13 +382,229 @@ func (h *Handlers) Health() func(http.ResponseWriter, *http.Request) {
 	}
 }
 
+// public allows requests matching a public route, or coming from its public ranges, without authentication.
+// It denies client ips the route does not admit.
+func (h *Handlers) public(w http.ResponseWriter, req *http.Request) bool {
+	rule := ruleFromContext(req.Context())
+	if rule == nil {
+		return false
+	}
+
+	public := rule.Public
+	if rule.HasCIDRs() {
+		rec := decision.FromContext(req.Context())
+		admitted, publicFrom := rule.AdmitsIP(rec.ClientIP), rule.PublicFrom(rec.ClientIP)
+		rec.Step(decision.StageClientIP, map[string]string{"client_ip": rec.ClientIP}, map[string]bool{"admitted": admitted, "public": publicFrom})
+		if !admitted {
+			rec.SetReason(decision.ReasonIPDenied)
+			rec.Deny()
+			h.jsonResponse(w, req, http.StatusForbidden, http.StatusText(http.StatusForbidden))
+			return true
+		}
+		public = public || publicFrom
+	}
+	if !public {
+		return false
+	}
+
+	if h.rateLimited(w, req, "") {
+		return true
+	}
+
+	decision.FromContext(req.Context()).Allow("")
+	h.jsonResponse(w, req, http.StatusOK, http.StatusText(http.StatusOK))
+
+	return true
+}
+
+// allow applies the route role requirement and returns the consumer headers
+func (h *Handlers) allow(w http.ResponseWriter, req *http.Request, consumerID string) {
+	h.allowHeaders(w, req, consumerID, nil)
+}
+
+// allowHeaders is allow returning extra headers to the proxy
+func (h *Handlers) allowHeaders(w http.ResponseWriter, req *http.Request, consumerID string, headers map[string]string) {
+	rec := decision.FromContext(req.Context())
+
+	if rule := ruleFromContext(req.Context()); rule != nil && len(rule.Roles) > 0 {
+		allowed := rule.HasRole(rec.Roles...)
+		rec.Step(decision.StageRoles, map[string]interface{}{"required": rule.Roles, "roles": rec.Roles}, map[string]bool{"allowed": allowed})
+		if !allowed {
+			rec.SetReason(decision.ReasonRoleDenied)
+			rec.Deny()
+			h.jsonResponse(w, req, http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
+			return
+		}
+	}
+
+	policyHeaders, err := h.srv.OPAAllowed(req, consumerID)
+	if err != nil {
+		h.cError(w, req, err)
+		return
+	}
+
+	if h.rateLimited(w, req, consumerID) {
+		return
+	}
+
+	rec.Allow(consumerID)
+	w.Header().Set(h.cfg.Headers.ConsumerID, consumerID)
+	if h.cfg.Headers.Role != "" && rec.Role != "" {
+		w.Header().Set(h.cfg.Headers.Role, rec.Role)
+	}
+	if h.cfg.Headers.CognitoPool != "" && rec.Pool != "" {
+		w.Header().Set(h.cfg.Headers.CognitoPool, rec.Pool)
+	}
+	for name, value := range headers {
+		w.Header().Set(name, value)
+	}
+	for name, value := range policyHeaders {
+		w.Header().Set(name, value)
+	}
+	h.jsonResponse(w, req, http.StatusOK, http.StatusText(http.StatusOK))
+}
+
+// blocked answers 429 to client ips blocked for sending invalid credentials
+func (h *Handlers) blocked(w http.ResponseWriter, req *http.Request) bool {
+	d, err := h.srv.BruteForceBlocked(req)
+	if err == nil {
+		return false
+	}
+
+	w.Header().Set("Retry-After", seconds(d))
+	h.cError(w, req, err)
+
+	return true
+}
+
+// rateLimited answers 429 with the rate limit headers when the route budget of the consumer is spent
+func (h *Handlers) rateLimited(w http.ResponseWriter, req *http.Request, consumerID string) bool {
+	res, err := h.srv.RateLimit(req, ruleFromContext(req.Context()), consumerID)
+	if err == nil {
+		return false
+	}
+
+	if res != nil {
+		w.Header().Set("Retry-After", seconds(res.RetryAfter))
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+		w.Header().Set("RateLimit-Reset", seconds(res.Reset))
+	}
+	h.cError(w, req, err)
+
+	return true
+}
+
+// seconds formats d as whole seconds rounded up, for Retry-After
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// begin attaches a decision record to the request
+func (h *Handlers) begin(req *http.Request, authType string) (*http.Request, *decision.Record) {
+	// dry runs export no spans, their upstream calls then start none either
+	if decision.ExplainFromContext(req.Context()) == nil {
+		req = h.srv.Tracer.Parent(req)
+	}
+	rec := decision.New(authType)
+	rec.Tenant = h.cfg.Tenant
+	rec.RequestID = requestID(req)
+	fr := forward.FromContext(req.Context())
+	rec.Method = fr.Method
+	rec.Host = fr.Host
+	rec.URI = redact.URI(fr.URI)
+	rec.ClientIP = fr.ClientIP
+	rec.TokenHash = audit.HashToken(bearerToken(req))
+	if ex := decision.ExplainFromContext(req.Context()); ex != nil {
+		rec.Explain, ex.Record = ex, rec
+	} else {
+		metrics.InFlight.WithLabelValues(authType).Inc()
+	}
+	if c := decision.CaptureFromContext(req.Context()); c != nil {
+		c.Record = rec
+	}
+
+	ctx := decision.NewContext(req.Context(), rec)
+	rec.Route = route.DefaultName
+	rule := h.cfg.Routes.Match(rec.Host, rec.URI, rec.Method)
+	if rule != nil {
+		rec.Route = rule.Name
+		ctx = context.WithValue(ctx, ruleCtxKey{}, rule)
+	}
+	rec.Step(decision.StageRoute, map[string]string{"method": rec.Method, "host": rec.Host, "uri": rec.URI}, ruleStep(rec.Route, rule))
+
+	return req.WithContext(ctx), rec
+}
+
+// ruleStep describes the matched route rule to dry runs
+func ruleStep(name string, rule *route.Rule) map[string]interface{} {
+	step := map[string]interface{}{"name": name}
+	if rule != nil {
+		step["hosts"] = rule.Hosts
+		step["path_prefix"] = rule.PathPrefix
+		step["methods"] = rule.Methods
+		step["public"] = rule.Public
+		step["roles"] = rule.Roles
+		if rule.HasCIDRs() {
+			step["deny_cidrs"] = rule.DenyCIDRs
+			step["allow_cidrs"] = rule.AllowCIDRs
+			step["public_cidrs"] = rule.PublicCIDRs
+		}
+		if rl := rule.RateLimit; rl != nil {
+			step["rate_limit"] = map[string]interface{}{"requests": rl.Requests, "per": rl.Per.String(), "burst": rl.Burst, "key": rl.Key}
+		}
+	}
+
+	return step
+}
+
+type ruleCtxKey struct{}
+
+func ruleFromContext(ctx context.Context) *route.Rule {
+	rule, _ := ctx.Value(ruleCtxKey{}).(*route.Rule)
+	return rule
+}
+
+// finish exports the decision record to metrics and the access log
+func (h *Handlers) finish(req *http.Request, rec *decision.Record) {
+	rec.Finish()
+	rec.TraceID = tracer.TraceID(req.Context())
+	if rec.DryRun() {
+		return
+	}
+	h.srv.BruteForceCount(rec)
+	metrics.InFlight.WithLabelValues(rec.AuthType).Dec()
+	metrics.Observe(rec)
+	h.accessLog.Log(rec)
+
+	if err := h.auditor.Log(rec); err != nil {
+		log.Error().Err(err).Str("request_id", rec.RequestID).Msg("audit log")
+	}
+}
+
 // check error
 func (h *Handlers) cError(w http.ResponseWriter, req *http.Request, err interface{}) {
+	if err == services.ErrUnauthorized || err == services.ErrTooManyRequests {
+		decision.FromContext(req.Context()).Deny()
+	} else {
+		rec := decision.FromContext(req.Context())
+		rec.Fail()
+		if rec.DryRun() {
+			rec.Explain.Error = fmt.Sprint(err)
+		}
+	}
+
+	if err == services.ErrTooManyRequests {
+		h.jsonResponse(w, req, http.StatusTooManyRequests, http.StatusText(http.StatusTooManyRequests))
+		return
+	}
+
 	if _, ok := err.(services.CError); ok {
 		h.jsonResponse(w, req, http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
 		return
 	}
 
+	decision.FromContext(req.Context()).SetStatus(http.StatusInternalServerError)
 	http.Error(w, err.(error).Error(), http.StatusInternalServerError)
 }
 
@@ -135,17 +615,30 @@ func (h *Handlers) jsonResponse(w http.ResponseWriter, req *http.Request, status
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	decision.FromContext(req.Context()).SetStatus(status)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
 	if _, err := w.Write(js); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+}
+
+// bearerToken returns the token only to fingerprint it
+func bearerToken(req *http.Request) string {
+	return strings.TrimPrefix(req.Header.Get("Authorization"), services.AuthBearer+" ")
+}
+
+// requestID reuses the id set by the proxy or generates a new one
+func requestID(req *http.Request) string {
+	if id := req.Header.Get(HeaderXRequestID); id != "" {
+		return id
+	}
 
-	reqID := "undefined"
-	if traceID := req.Header.Get("Uber-Trace-Id"); len(traceID) > 1 {
-		reqID = traceID
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "undefined"
 	}
 
-	log.Info().Msgf("{\"request-id\": %s, \"status\": %s, \"took\": %s}\n", reqID, strconv.Itoa(status), time.Since(h.startTime))
+	return hex.EncodeToString(b)
 }
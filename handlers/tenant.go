@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"traefik-tower/pkg/forward"
+	"traefik-tower/pkg/route"
+)
+
+// PathVarTenant is the mux variable holding the tenant name in /t/{tenant}
+const PathVarTenant = "tenant"
+
+type tenantHandler struct {
+	name    string
+	hosts   []string
+	handler http.Handler
+}
+
+// TenantRouter dispatches auth requests to the tenant selected by the /t/{tenant} path
+// or by the forwarded host. Requests for no tenant go to the default handler.
+type TenantRouter struct {
+	tenants []tenantHandler
+	byName  map[string]http.Handler
+	def     http.Handler
+}
+
+func NewTenantRouter(def http.Handler) *TenantRouter {
+	return &TenantRouter{
+		byName: map[string]http.Handler{},
+		def:    def,
+	}
+}
+
+// Add registers a tenant, host patterns are matched in the order tenants are added
+func (tr *TenantRouter) Add(name string, hosts []string, h http.Handler) {
+	tr.tenants = append(tr.tenants, tenantHandler{name: name, hosts: hosts, handler: h})
+	tr.byName[name] = h
+}
+
+// ServeHTTP selects the tenant by the forwarded host
+func (tr *TenantRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	host := forward.FromContext(req.Context()).Host
+	for _, t := range tr.tenants {
+		if len(t.hosts) > 0 && route.MatchHost(t.hosts, host) {
+			t.handler.ServeHTTP(w, req)
+			return
+		}
+	}
+
+	tr.def.ServeHTTP(w, req)
+}
+
+// ByPath selects the tenant by the {tenant} path variable
+func (tr *TenantRouter) ByPath(w http.ResponseWriter, req *http.Request) {
+	h, ok := tr.byName[mux.Vars(req)[PathVarTenant]]
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	h.ServeHTTP(w, req)
+}
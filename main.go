@@ -1,30 +1,30 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
-	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"time"
 	"traefik-tower/config"
-	"traefik-tower/handlers"
-	"traefik-tower/pkg/client"
+	"traefik-tower/pkg/accesslog"
+	"traefik-tower/pkg/audit"
+	"traefik-tower/pkg/extauthz"
 	"traefik-tower/pkg/gohttp"
+	"traefik-tower/pkg/metrics"
 	"traefik-tower/pkg/middelware"
+	"traefik-tower/pkg/ratelimit"
+	"traefik-tower/pkg/redact"
+	"traefik-tower/pkg/reload"
 	"traefik-tower/pkg/tracer"
-	"traefik-tower/services"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	cognito "github.com/aws/aws-sdk-go/service/cognitoidentityprovider"
-	"github.com/gorilla/mux"
-	"github.com/opentracing/opentracing-go"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	zLog "github.com/rs/zerolog/log"
-	jaegerConf "github.com/uber/jaeger-client-go/config"
-	jaegerlog "github.com/uber/jaeger-client-go/log"
-	"github.com/uber/jaeger-lib/metrics/prometheus"
 )
 
 const (
@@ -33,68 +33,112 @@ const (
 )
 
 func main() {
-	var (
-		httpClient *client.HTTPClient
-		cn         *cognito.CognitoIdentityProvider
-	)
+	// subcommands
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
+
 	// init config
-	cfg, err := config.FromEnv()
+	configFile := os.Getenv(config.EnvConfigFile)
+	cfg, err := config.Load(configFile)
 	if err != nil {
 		zLog.Fatal().Err(err).Msg("init config")
 		return
 	}
 
-	if cfg.IsAuthServiceURL() {
-		// http client
-		httpClient, err = client.NewClient(cfg.AuthServerURL)
+	// mask configured claims in debug logs
+	redact.AddClaims(cfg.RedactClaims...)
+	redact.AddClaims(cfg.APIKeyQueryParam)
+	redact.AddHeaders(cfg.APIKeyHeader)
+
+	// Initialize OpenTelemetry tracer provider and propagators
+	tracingShutdown, err := tracing(cfg)
+	if err != nil {
+		zLog.Fatal().Err(err).Msg("tracing error")
+	}
+
+	defer func() {
+		if err := tracingShutdown(context.Background()); err != nil {
+			zLog.Error().Err(err).Msg("tracing shutdown")
+		}
+	}()
+
+	// access log
+	var accessLog *accesslog.Logger
+	if cfg.AccessLog {
+		accessLog, err = accesslog.New(accesslog.Options{
+			Output:     cfg.AccessLogOutput,
+			SampleRate: cfg.AccessLogSampleRate,
+		})
 		if err != nil {
-			zLog.Fatal().Err(err).Msg("http client error")
+			zLog.Fatal().Err(err).Msg("access log error")
 		}
+		defer accessLog.Close()
 	}
-	// Initialize tracer with a logger and a metrics factory
-	jaegerTracer, jaegerCloser, err := tracing(cfg)
+
+	// audit log
+	auditor, err := newAuditor(cfg)
 	if err != nil {
-		zLog.Fatal().Err(err).Msg("jaeger error")
+		zLog.Fatal().Err(err).Msg("audit log error")
 	}
+	// closed after the shutdown drained in-flight requests, which still log decisions
+	defer auditor.Close()
 
-	defer jaegerCloser.Close()
+	// listener, tracing, access and audit logs and rate limits live for the whole process, the session
+	// cache and client blocks are kept across reloads while their settings are unchanged
+	shared := &sharedDeps{
+		accessLog: accessLog,
+		auditor:   auditor,
+		limits:    ratelimit.NewMemory(),
+	}
+	metrics.BlockedClients(func() int { return shared.blocks.Load().BlockedCount() })
+
+	routerHandler, err := newRouter(cfg, shared)
+	if err != nil {
+		zLog.Fatal().Err(err).Msg("init handlers")
+	}
+	shared.kept.commit()
+	handler := reload.NewHandler(routerHandler)
 
-	// init tracer
-	tr := tracer.NewTracer(jaegerTracer)
+	// hot reload on config file change or SIGHUP
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	if !cfg.IsAuthServiceURL() {
-		cn, err = cognitoAwsConnected(cfg)
+	reloadConfig := func() {
+		newCfg, err := config.Load(configFile)
 		if err != nil {
-			zLog.Fatal().Err(err).Msg("cognitoAwsConnected error")
+			metrics.ConfigReloads.WithLabelValues("error").Inc()
+			zLog.Error().Err(err).Msg("config reload, keeping the current config")
+			return
 		}
-	}
 
-	// sefrvices
-	srv := services.NewService(cfg, httpClient, tr, cn)
+		r, err := newRouter(newCfg, shared)
+		if err != nil {
+			shared.kept.discard()
+			metrics.ConfigReloads.WithLabelValues("error").Inc()
+			zLog.Error().Err(err).Msg("config reload, keeping the current config")
+			return
+		}
 
-	// handlers
-	h := handlers.NewHandlers(cfg, srv)
-	routerHandler := mux.NewRouter()
-	switch cfg.AuthType {
-	case "cognito":
-		routerHandler.HandleFunc("/", h.Cognito)
-	case "cognito-aws":
-		routerHandler.HandleFunc("/", h.CognitoAWS)
-	case "hydra-keto":
-		routerHandler.HandleFunc("/", h.HydraKeto)
-	default:
-		routerHandler.HandleFunc("/", h.Hydra)
+		redact.AddClaims(newCfg.RedactClaims...)
+		redact.AddClaims(newCfg.APIKeyQueryParam)
+		redact.AddHeaders(newCfg.APIKeyHeader)
+		handler.Store(r)
+		shared.kept.commit()
+		metrics.ConfigReloads.WithLabelValues("success").Inc()
+		zLog.Info().Msg("config reloaded")
 	}
 
-	routerHandler.HandleFunc("/health", h.Health())
-	routerHandler.Handle("/metrics", promhttp.Handler())
-	if cfg.Debug {
-		routerHandler.HandleFunc("/200", h.AlwaysSuccess)
-		routerHandler.HandleFunc("/404", h.AlwaysFail)
+	if configFile != "" {
+		if err := reload.Watch(ctx, configFile, reloadConfig); err != nil {
+			zLog.Fatal().Err(err).Msg("config watcher")
+		}
+	} else {
+		reload.WatchSignal(ctx, reloadConfig)
 	}
 
 	s := &http.Server{
-		Handler:      routerHandler,
+		Handler:      handler,
 		Addr:         fmt.Sprintf("%s:%s", cfg.Host, cfg.Port),
 		WriteTimeout: HTTPWriteTimeout,
 		ReadTimeout:  HTTPReadTimeout,
@@ -105,22 +149,57 @@ func main() {
 		s.Handler = middelware.Logger(s.Handler)
 	}
 
-	go gohttp.Shutdown(s)
+	// envoy ext_authz listener, serves checks through the same handler
+	var shutdowner gohttp.Shutdowner = s
+	if cfg.ExtAuthzPort != "" {
+		addr := fmt.Sprintf("%s:%s", cfg.Host, cfg.ExtAuthzPort)
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			zLog.Fatal().Err(err).Msg("ext_authz listen error")
+		}
+
+		var tlsConfig *tls.Config
+		if cfg.ExtAuthzTLSCertFile != "" {
+			if tlsConfig, err = extauthz.TLSConfig(cfg.ExtAuthzTLSCertFile, cfg.ExtAuthzTLSKeyFile, cfg.ExtAuthzTLSClientCAFile); err != nil {
+				zLog.Fatal().Err(err).Msg("ext_authz tls error")
+			}
+		}
+
+		extAuthz := extauthz.NewServer(handler, tlsConfig)
+		shutdowner = gohttp.Shutdowners{extAuthz, s}
+
+		go func() {
+			if err := extAuthz.Serve(l); err != nil {
+				zLog.Fatal().Err(err).Msg("ext_authz serve error")
+			}
+		}()
+
+		zLog.Info().Msgf("Envoy ext_authz gRPC server started at host:port: [%s]", addr)
+	}
+
+	// ListenAndServe returns as soon as the shutdown starts, wait for it so the deferred closes of the
+	// access and audit logs run after the last handler finished
+	shutdown := make(chan struct{})
+	go func() {
+		gohttp.Shutdown(shutdowner)
+		close(shutdown)
+	}()
 
 	zLog.Info().Msgf("Server started at host:port: [%s:%s]", cfg.Host, cfg.Port)
 
 	if err := s.ListenAndServe(); err != http.ErrServerClosed {
 		zLog.Fatal().Msgf("listenAndServe error: %s", err)
 	}
+	<-shutdown
 }
 
 // Cognito AWS Connected
-func cognitoAwsConnected(cfg *config.Config) (*cognito.CognitoIdentityProvider, error) {
+func cognitoAwsConnected(region, profile string) (*cognito.CognitoIdentityProvider, error) {
 	sessionParams := session.Options{
-		Config: aws.Config{Region: aws.String(cfg.AwsRegion)},
+		Config: aws.Config{Region: aws.String(region)},
 	}
-	if cfg.AwsProfile != "" {
-		sessionParams.Profile = cfg.AwsProfile
+	if profile != "" {
+		sessionParams.Profile = profile
 	}
 
 	sess, err := session.NewSessionWithOptions(sessionParams)
@@ -131,33 +210,40 @@ func cognitoAwsConnected(cfg *config.Config) (*cognito.CognitoIdentityProvider,
 	return cognito.New(sess), nil
 }
 
-// init tracing
-func tracing(cfg *config.Config) (opentracing.Tracer, io.Closer, error) {
-	var jLogger jaegerlog.Logger
-	// init Jaeger config
-	cfgJaeger, err := jaegerConf.FromEnv()
-	if err != nil {
-		return nil, nil, err
-	}
-	if len(cfg.TracingDebug) < 1 {
-		jLogger = jaegerlog.NullLogger
-	}
-	if cfg.TracingDebug == "true" {
-		jLogger = jaegerlog.StdLogger
-	}
-
-	// prometheus
-	jMetricsFactory := prometheus.New()
+// init audit log, nil when disabled
+func newAuditor(cfg *config.Config) (*audit.Auditor, error) {
+	var sink audit.Sink
 
-	// Initialize tracer with a logger and a metrics factory
-	jaegerTracer, jaegerCloser, err := cfgJaeger.NewTracer(
-		jaegerConf.Logger(jLogger),
-		jaegerConf.Metrics(jMetricsFactory),
-	)
+	if !cfg.Audit {
+		return nil, nil
+	}
 
-	if err != nil {
-		return nil, nil, err
+	switch cfg.AuditSink {
+	case "file":
+		fs, err := audit.NewFileSink(cfg.AuditFile, int64(cfg.AuditFileMaxSizeMB)<<20, cfg.AuditFileMaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		sink = fs
+	case "webhook":
+		ws, err := audit.NewWebhookSink(cfg.AuditWebhookURL, cfg.AuditWebhookTimeout, cfg.AuditWebhookSpool)
+		if err != nil {
+			return nil, err
+		}
+		sink = ws
+	default:
+		return nil, fmt.Errorf("unknown audit sink %q", cfg.AuditSink)
 	}
 
-	return jaegerTracer, jaegerCloser, nil
+	return audit.NewAuditor(sink)
+}
+
+// init tracing
+func tracing(cfg *config.Config) (func(context.Context) error, error) {
+	return tracer.Init(context.Background(), tracer.Options{
+		ServiceName: cfg.TracingServiceName,
+		Exporter:    cfg.TracingExporter,
+		Propagators: cfg.TracingPropagators,
+		Debug:       cfg.TracingDebug == "true",
+	})
 }
@@ -0,0 +1,130 @@
+package accesslog
+
+import (
+	"io"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"traefik-tower/pkg/decision"
+)
+
+const (
+	OutputStdout = "stdout"
+	OutputStderr = "stderr"
+)
+
+type Options struct {
+	// Output is "stdout", "stderr" or a file path
+	Output string
+	// SampleRate is the fraction of allowed decisions to log, denied and failed ones are always logged
+	SampleRate float64
+}
+
+type Logger struct {
+	logger     zerolog.Logger
+	sampleRate float64
+	closer     io.Closer
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+func New(opts Options) (*Logger, error) {
+	var (
+		w      io.Writer
+		closer io.Closer
+	)
+
+	switch opts.Output {
+	case OutputStdout, "":
+		w = os.Stdout
+	case OutputStderr:
+		w = os.Stderr
+	default:
+		f, err := os.OpenFile(opts.Output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+		if err != nil {
+			return nil, err
+		}
+		w, closer = f, f
+	}
+
+	return &Logger{
+		logger:     zerolog.New(w).With().Timestamp().Logger(),
+		sampleRate: opts.SampleRate,
+		closer:     closer,
+		rand:       rand.New(rand.NewSource(time.Now().UnixNano())), // nolint: gosec
+	}, nil
+}
+
+// Log writes one entry per decision, a nil logger discards everything
+func (l *Logger) Log(rec *decision.Record) {
+	if l == nil || rec == nil || !l.sampled(rec) {
+		return
+	}
+
+	stages := zerolog.Dict()
+	for _, s := range rec.Stages {
+		stages.Float64(s.Name, durationMs(s.Duration))
+	}
+
+	upstreams := zerolog.Arr()
+	for _, u := range rec.Upstreams {
+		upstreams.Object(upstream(u))
+	}
+
+	l.logger.Log().
+		Str("request_id", rec.RequestID).
+		Str("trace_id", rec.TraceID).
+		Str("tenant", rec.Tenant).
+		Str("auth_type", rec.AuthType).
+		Str("route", rec.Route).
+		Str("method", rec.Method).
+		Str("host", rec.Host).
+		Str("uri", rec.URI).
+		Str("client_ip", rec.ClientIP).
+		Str("consumer_id", rec.ConsumerID).
+		Str("role", rec.Role).
+		Str("pool", rec.Pool).
+		Str("decision", string(rec.Outcome)).
+		Str("reason", rec.Reason).
+		Int("status", rec.Status).
+		Float64("took_ms", durationMs(rec.Took())).
+		Dict("stages_ms", stages).
+		Array("upstreams", upstreams).
+		Send()
+}
+
+func (l *Logger) Close() error {
+	if l == nil || l.closer == nil {
+		return nil
+	}
+	return l.closer.Close()
+}
+
+func (l *Logger) sampled(rec *decision.Record) bool {
+	if rec.Outcome != decision.OutcomeAllow || l.sampleRate >= 1 {
+		return true
+	}
+	if l.sampleRate <= 0 {
+		return false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.rand.Float64() < l.sampleRate
+}
+
+type upstream decision.Upstream
+
+func (u upstream) MarshalZerologObject(e *zerolog.Event) {
+	e.Str("name", u.Name).Int("status", u.Status)
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
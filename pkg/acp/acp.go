@@ -0,0 +1,386 @@
+package acp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Matching flavors of the ORY ACP engines
+const (
+	FlavorExact = "exact"
+	FlavorGlob  = "glob"
+	FlavorRegex = "regex"
+)
+
+var Flavors = []string{FlavorExact, FlavorGlob, FlavorRegex}
+
+const (
+	EffectAllow = "allow"
+	EffectDeny  = "deny"
+)
+
+// Policy is an ORY ACP policy as stored by Keto
+type Policy struct {
+	ID          string                 `json:"id" yaml:"id"`
+	Description string                 `json:"description" yaml:"description,omitempty"`
+	Subjects    []string               `json:"subjects" yaml:"subjects"`
+	Resources   []string               `json:"resources" yaml:"resources"`
+	Actions     []string               `json:"actions" yaml:"actions"`
+	Effect      string                 `json:"effect" yaml:"effect"`
+	Conditions  map[string]interface{} `json:"conditions,omitempty" yaml:"conditions,omitempty"`
+}
+
+// Role groups subjects, a policy naming the role applies to its members
+type Role struct {
+	ID      string   `json:"id" yaml:"id"`
+	Members []string `json:"members" yaml:"members"`
+}
+
+// Document is the content of policy files, either a list of policies as exported from Keto
+// or a map with policies and roles
+type Document struct {
+	Policies []Policy `yaml:"policies"`
+	Roles    []Role   `yaml:"roles"`
+}
+
+// LoadFiles reads YAML or JSON policy files, directories are read for *.json, *.yaml and *.yml files
+func LoadFiles(paths []string) (*Document, error) {
+	var files []string
+	for _, p := range paths {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			files = append(files, p)
+			continue
+		}
+
+		entries, err := os.ReadDir(p)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			switch filepath.Ext(e.Name()) {
+			case ".json", ".yaml", ".yml":
+				if !e.IsDir() {
+					files = append(files, filepath.Join(p, e.Name()))
+				}
+			}
+		}
+	}
+
+	doc := &Document{}
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		d, err := parse(b)
+		if err != nil {
+			return nil, fmt.Errorf("policy file %s: %w", f, err)
+		}
+		doc.Policies = append(doc.Policies, d.Policies...)
+		doc.Roles = append(doc.Roles, d.Roles...)
+	}
+
+	return doc, doc.Validate()
+}
+
+func parse(b []byte) (*Document, error) {
+	d := &Document{}
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("[")) {
+		return d, yaml.Unmarshal(b, &d.Policies)
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(d); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// Validate checks ids and effects, the patterns are checked when compiled
+func (d *Document) Validate() error {
+	ids := map[string]bool{}
+	for _, p := range d.Policies {
+		if p.ID == "" {
+			return fmt.Errorf("policy without id")
+		}
+		if ids[p.ID] {
+			return fmt.Errorf("policy %s: duplicate id", p.ID)
+		}
+		ids[p.ID] = true
+		if p.Effect != EffectAllow && p.Effect != EffectDeny {
+			return fmt.Errorf("policy %s: effect must be allow or deny, got %q", p.ID, p.Effect)
+		}
+	}
+
+	roles := map[string]bool{}
+	for _, r := range d.Roles {
+		if r.ID == "" {
+			return fmt.Errorf("role without id")
+		}
+		if roles[r.ID] {
+			return fmt.Errorf("role %s: duplicate id", r.ID)
+		}
+		roles[r.ID] = true
+	}
+
+	return nil
+}
+
+type matcher func(string) bool
+
+type compiled struct {
+	*Policy
+	subjects, resources, actions []matcher
+}
+
+// Engine evaluates policies like the Keto ACP engine of one flavor: a request is allowed when an
+// allow policy matches and no deny policy does
+type Engine struct {
+	policies []*compiled
+	// roles by member
+	roles map[string][]string
+}
+
+// Load reads the policy files and compiles them for flavor
+func Load(flavor string, paths []string) (*Engine, error) {
+	doc, err := LoadFiles(paths)
+	if err != nil {
+		return nil, err
+	}
+
+	return New(flavor, doc)
+}
+
+// New compiles the policies of doc for flavor. Policies with conditions are rejected, they are evaluated
+// against a request context the tower does not have, and skipping them would turn a conditional deny
+// into an allow.
+func New(flavor string, doc *Document) (*Engine, error) {
+	e := &Engine{roles: map[string][]string{}}
+	for i := range doc.Policies {
+		p := &doc.Policies[i]
+		if len(p.Conditions) > 0 {
+			return nil, fmt.Errorf("policy %s: conditions are not supported, evaluate it with keto instead", p.ID)
+		}
+
+		c := &compiled{Policy: p}
+		for _, m := range []struct {
+			patterns []string
+			dst      *[]matcher
+		}{{p.Subjects, &c.subjects}, {p.Resources, &c.resources}, {p.Actions, &c.actions}} {
+			for _, pattern := range m.patterns {
+				fn, err := compile(flavor, pattern)
+				if err != nil {
+					return nil, fmt.Errorf("policy %s: %w", p.ID, err)
+				}
+				*m.dst = append(*m.dst, fn)
+			}
+		}
+		e.policies = append(e.policies, c)
+	}
+
+	for _, r := range doc.Roles {
+		for _, m := range r.Members {
+			e.roles[m] = append(e.roles[m], r.ID)
+		}
+	}
+
+	return e, nil
+}
+
+// Allowed evaluates the request and returns the matching policies
+func (e *Engine) Allowed(subject, resource, action string) (bool, []*Policy) {
+	subjects := append([]string{subject}, e.roles[subject]...)
+
+	var (
+		allowed, denied bool
+		matched         []*Policy
+	)
+	for _, p := range e.policies {
+		if !matchAny(p.actions, action) || !matchAny(p.resources, resource) {
+			continue
+		}
+		subjectMatch := false
+		for _, s := range subjects {
+			if matchAny(p.subjects, s) {
+				subjectMatch = true
+				break
+			}
+		}
+		if !subjectMatch {
+			continue
+		}
+
+		matched = append(matched, p.Policy)
+		if p.Effect == EffectDeny {
+			denied = true
+		} else {
+			allowed = true
+		}
+	}
+
+	return allowed && !denied, matched
+}
+
+// Len returns the number of policies
+func (e *Engine) Len() int {
+	return len(e.policies)
+}
+
+func matchAny(ms []matcher, s string) bool {
+	for _, m := range ms {
+		if m(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Resource maps the forwarded URI to the resource checked by Keto, a/b/c becomes a:b:c and / becomes home
+func Resource(uri string) string {
+	rPath := strings.ReplaceAll(strings.Trim(uri, "/"), `/`, `:`)
+	if rPath == "" {
+		return "home"
+	}
+	return rPath
+}
+
+func compile(flavor, pattern string) (matcher, error) {
+	switch flavor {
+	case FlavorExact:
+		return func(s string) bool { return s == pattern }, nil
+	case FlavorGlob:
+		re, err := regexp.Compile(globRegexp(pattern))
+		if err != nil {
+			return nil, fmt.Errorf("glob %q: %w", pattern, err)
+		}
+		return re.MatchString, nil
+	case FlavorRegex:
+		if !strings.Contains(pattern, "<") {
+			return func(s string) bool { return s == pattern }, nil
+		}
+		expr, err := ladonRegexp(pattern)
+		if err != nil {
+			return nil, err
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("regex %q: %w", pattern, err)
+		}
+		return re.MatchString, nil
+	}
+
+	return nil, fmt.Errorf("unknown flavor %q, must be one of %s", flavor, strings.Join(Flavors, ", "))
+}
+
+// ladonRegexp turns a pattern like users:<[0-9]+> into a regexp, text outside <> is literal
+func ladonRegexp(pattern string) (string, error) {
+	var sb strings.Builder
+	sb.WriteString("^")
+
+	rest := pattern
+	for {
+		start := strings.IndexByte(rest, '<')
+		if start < 0 {
+			sb.WriteString(regexp.QuoteMeta(rest))
+			break
+		}
+		sb.WriteString(regexp.QuoteMeta(rest[:start]))
+
+		// the regex part may contain nested <> pairs
+		depth, end := 0, -1
+		for i := start; i < len(rest); i++ {
+			switch rest[i] {
+			case '<':
+				depth++
+			case '>':
+				depth--
+			}
+			if depth == 0 {
+				end = i
+				break
+			}
+		}
+		if end < 0 {
+			return "", fmt.Errorf("regex %q: unbalanced <>", pattern)
+		}
+		sb.WriteString("(" + rest[start+1:end] + ")")
+		rest = rest[end+1:]
+	}
+	sb.WriteString("$")
+
+	return sb.String(), nil
+}
+
+// globRegexp translates a glob with : as separator: * does not cross a separator, ** does,
+// ? is one non separator character, [a-z] and [!a-z] are classes and {a,b} are alternatives
+func globRegexp(pattern string) string {
+	var sb strings.Builder
+	sb.WriteString("^")
+
+	inAlt := false
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case c == '*' && i+1 < len(pattern) && pattern[i+1] == '*':
+			sb.WriteString(".*")
+			i++
+		case c == '*':
+			sb.WriteString("[^:]*")
+		case c == '?':
+			sb.WriteString("[^:]")
+		case c == '[':
+			end := strings.IndexByte(pattern[i:], ']')
+			if end < 0 {
+				sb.WriteString(regexp.QuoteMeta(pattern[i:]))
+				i = len(pattern)
+				continue
+			}
+			class := pattern[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + class + "]")
+			i += end
+		case c == '{':
+			inAlt = true
+			sb.WriteString("(?:")
+		case c == '}' && inAlt:
+			inAlt = false
+			sb.WriteString(")")
+		case c == ',' && inAlt:
+			sb.WriteString("|")
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			sb.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	sb.WriteString("$")
+
+	return sb.String()
+}
+
+// SortedIDs returns the ids of policies, e.g. for logs
+func SortedIDs(policies []*Policy) []string {
+	ids := make([]string, 0, len(policies))
+	for _, p := range policies {
+		ids = append(ids, p.ID)
+	}
+	sort.Strings(ids)
+	return ids
+}
@@ -0,0 +1,227 @@
+package acp
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+type check struct {
+	subject, resource, action string
+	allowed                   bool
+}
+
+func testAllowed(t *testing.T, flavor string, doc *Document, checks []check) {
+	t.Helper()
+
+	e, err := New(flavor, doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range checks {
+		if allowed, matched := e.Allowed(c.subject, c.resource, c.action); allowed != c.allowed {
+			t.Errorf("%s Allowed(%q, %q, %q) = %t, want %t, matched %v",
+				flavor, c.subject, c.resource, c.action, allowed, c.allowed, SortedIDs(matched))
+		}
+	}
+}
+
+func TestAllowedExact(t *testing.T) {
+	doc := &Document{
+		Policies: []Policy{
+			{
+				ID:        "editors",
+				Subjects:  []string{"roles:editors"},
+				Resources: []string{"posts"},
+				Actions:   []string{"GET", "POST"},
+				Effect:    EffectAllow,
+			},
+			{ID: "no-bob", Subjects: []string{"users:bob"}, Resources: []string{"posts"}, Actions: []string{"POST"}, Effect: EffectDeny},
+			{ID: "pattern", Subjects: []string{"users:*"}, Resources: []string{"posts"}, Actions: []string{"GET"}, Effect: EffectAllow},
+		},
+		Roles: []Role{{ID: "roles:editors", Members: []string{"users:alice", "users:bob"}}},
+	}
+
+	testAllowed(t, FlavorExact, doc, []check{
+		{"users:alice", "posts", "POST", true},
+		{"users:bob", "posts", "GET", true},
+		{"users:bob", "posts", "POST", false},
+		{"roles:editors", "posts", "GET", true},
+		{"users:carol", "posts", "GET", false},
+		{"users:*", "posts", "GET", true},
+		{"users:alice", "posts:1", "GET", false},
+		{"users:alice", "posts", "get", false},
+	})
+}
+
+func TestAllowedGlob(t *testing.T) {
+	doc := &Document{
+		Policies: []Policy{
+			{ID: "read", Subjects: []string{"users:*"}, Resources: []string{"blog:*"}, Actions: []string{"GET"}, Effect: EffectAllow},
+			{ID: "admin", Subjects: []string{"roles:admin"}, Resources: []string{"**"}, Actions: []string{"*"}, Effect: EffectAllow},
+			{ID: "drafts", Subjects: []string{"**"}, Resources: []string{"blog:drafts"}, Actions: []string{"*"}, Effect: EffectDeny},
+			{
+				ID:        "items",
+				Subjects:  []string{"users:?ob"},
+				Resources: []string{"api:items:[0-9]"},
+				Actions:   []string{"{PUT,PATCH}"},
+				Effect:    EffectAllow,
+			},
+			{
+				ID:        "not-v",
+				Subjects:  []string{"users:alice"},
+				Resources: []string{"api:[!v]*"},
+				Actions:   []string{"DELETE"},
+				Effect:    EffectAllow,
+			},
+		},
+		Roles: []Role{{ID: "roles:admin", Members: []string{"users:carol"}}},
+	}
+
+	testAllowed(t, FlavorGlob, doc, []check{
+		{"users:alice", "blog:post", "GET", true},
+		// * does not cross the separator, ** does
+		{"users:alice", "blog:post:comments", "GET", false},
+		{"users:carol", "blog:post:comments", "DELETE", true},
+		{"users:alice", "blog:post", "POST", false},
+		// deny overrides allow, also for role members
+		{"users:alice", "blog:drafts", "GET", false},
+		{"users:carol", "blog:drafts", "GET", false},
+		{"users:bob", "api:items:7", "PUT", true},
+		{"users:bob", "api:items:7", "PATCH", true},
+		{"users:bob", "api:items:7", "POST", false},
+		{"users:bob", "api:items:42", "PUT", false},
+		{"users:rob", "api:items:1", "PATCH", true},
+		{"users:alice", "api:items", "DELETE", true},
+		{"users:alice", "api:v1", "DELETE", false},
+		{"service:alice", "blog:post", "GET", false},
+	})
+}
+
+func TestAllowedRegex(t *testing.T) {
+	doc := &Document{
+		Policies: []Policy{
+			{
+				ID:        "own",
+				Subjects:  []string{"users:<[a-z]+>"},
+				Resources: []string{"items:<[0-9]+>"},
+				Actions:   []string{"<GET|PUT>"},
+				Effect:    EffectAllow,
+			},
+			{
+				ID:        "nested",
+				Subjects:  []string{"users:<(?P<name>alice|bob)>"},
+				Resources: []string{"reports:<.*>"},
+				Actions:   []string{"GET"},
+				Effect:    EffectAllow,
+			},
+			{
+				ID:        "literal",
+				Subjects:  []string{"users:a.b"},
+				Resources: []string{"items:1"},
+				Actions:   []string{"DELETE"},
+				Effect:    EffectAllow,
+			},
+			{
+				ID:        "locked",
+				Subjects:  []string{"<.*>"},
+				Resources: []string{"items:<13|666>"},
+				Actions:   []string{"<.*>"},
+				Effect:    EffectDeny,
+			},
+			{ID: "ops", Subjects: []string{"roles:ops"}, Resources: []string{"<.*>"}, Actions: []string{"<.*>"}, Effect: EffectAllow},
+		},
+		Roles: []Role{{ID: "roles:ops", Members: []string{"users:dave1"}}},
+	}
+
+	testAllowed(t, FlavorRegex, doc, []check{
+		{"users:alice", "items:1", "GET", true},
+		{"users:alice", "items:1", "PUT", true},
+		{"users:alice", "items:1", "DELETE", false},
+		// the regex is anchored
+		{"users:alice", "items:1x", "GET", false},
+		{"users:Alice", "items:1", "GET", false},
+		{"users:bob", "reports:2026:q1", "GET", true},
+		{"users:carol", "reports:2026:q1", "GET", false},
+		// text outside <> is literal
+		{"users:a.b", "items:1", "DELETE", true},
+		{"users:axb", "items:1", "DELETE", false},
+		{"users:alice", "items:13", "GET", false},
+		{"users:dave1", "anything", "DELETE", true},
+		{"users:dave1", "items:666", "DELETE", false},
+	})
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name   string
+		flavor string
+		policy Policy
+		ok     bool
+	}{
+		{name: "unknown flavor", flavor: "ladon", policy: Policy{ID: "p", Subjects: []string{"a"}}},
+		{name: "unbalanced regex", flavor: FlavorRegex, policy: Policy{ID: "p", Subjects: []string{"users:<[a-z]+"}}},
+		{name: "invalid regex", flavor: FlavorRegex, policy: Policy{ID: "p", Subjects: []string{"users:<(>"}}},
+		{
+			name:   "conditions",
+			flavor: FlavorGlob,
+			policy: Policy{ID: "p", Subjects: []string{"a"}, Effect: EffectDeny, Conditions: map[string]interface{}{
+				"ip": map[string]interface{}{"type": "CIDRCondition"},
+			}},
+		},
+		{name: "valid", flavor: FlavorGlob, policy: Policy{ID: "p", Subjects: []string{"users:{a,b}"}}, ok: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(tt.flavor, &Document{Policies: []Policy{tt.policy}})
+			if (err == nil) != tt.ok {
+				t.Errorf("New() error = %v, want ok %t", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestLoadFiles(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"keto.json": `[{"id": "a", "subjects": ["users:alice"], "resources": ["blog"], "actions": ["GET"], "effect": "allow"}]`,
+		"roles.yaml": "policies:\n  - id: b\n    subjects: [roles:admin]\n    resources: [blog]\n    actions: [POST]\n    effect: allow\n" +
+			"roles:\n  - id: roles:admin\n    members: [users:alice]\n",
+		"notes.txt": "ignored",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	doc, err := LoadFiles([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, p := range doc.Policies {
+		ids = append(ids, p.ID)
+	}
+	if want := []string{"a", "b"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("policies = %v, want %v", ids, want)
+	}
+
+	dup := filepath.Join(t.TempDir(), "dup.yaml")
+	if err := os.WriteFile(dup, []byte("policies:\n  - {id: a, effect: allow}\n  - {id: a, effect: deny}\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadFiles([]string{dup}); err == nil {
+		t.Error("duplicate policy ids accepted")
+	}
+}
+
+func TestResource(t *testing.T) {
+	for uri, want := range map[string]string{"/": "home", "": "home", "/api/items/": "api:items", "/a/b/c": "a:b:c"} {
+		if got := Resource(uri); got != want {
+			t.Errorf("Resource(%q) = %q, want %q", uri, got, want)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package apikey
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Prefix starts every key, keys look like tt_<id>_<secret>
+const Prefix = "tt_"
+
+// refreshInterval limits how often the store file is checked for changes made by the CLI
+const refreshInterval = time.Second
+
+var (
+	ErrMalformed = errors.New("malformed api key")
+	ErrNotFound  = errors.New("api key not found")
+	ErrRevoked   = errors.New("api key revoked")
+	ErrExpired   = errors.New("api key expired")
+)
+
+// Key is a stored API key, only the SHA-256 of its secret is kept
+type Key struct {
+	ID        string     `json:"id"`
+	Hash      string     `json:"hash"`
+	Owner     string     `json:"owner"`
+	Roles     []string   `json:"roles,omitempty"`
+	Scopes    []string   `json:"scopes,omitempty"`
+	Routes    []string   `json:"routes,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// AllowsRoute reports whether the key may be used on the named route rule, keys without routes are allowed everywhere
+func (k *Key) AllowsRoute(name string) bool {
+	if len(k.Routes) == 0 {
+		return true
+	}
+	for _, r := range k.Routes {
+		if r == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Status is active, revoked or expired
+func (k *Key) Status(now time.Time) string {
+	switch {
+	case k.RevokedAt != nil:
+		return "revoked"
+	case k.ExpiresAt != nil && now.After(*k.ExpiresAt):
+		return "expired"
+	default:
+		return "active"
+	}
+}
+
+// Store keeps keys in a JSON file. The server picks up changes written by the CLI.
+type Store struct {
+	path string
+
+	mu      sync.RWMutex
+	keys    map[string]*Key
+	modTime time.Time
+	checked time.Time
+}
+
+// Open loads the store, a missing file is an empty store
+func Open(path string) (*Store, error) {
+	s := &Store{path: path, keys: map[string]*Key{}}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *Store) load() error {
+	fi, err := os.Stat(s.path)
+	if os.IsNotExist(err) {
+		s.keys, s.modTime = map[string]*Key{}, time.Time{}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+
+	var list []*Key
+	if err := json.Unmarshal(b, &list); err != nil {
+		return fmt.Errorf("api key store %s: %w", s.path, err)
+	}
+
+	keys := make(map[string]*Key, len(list))
+	for _, k := range list {
+		keys[k.ID] = k
+	}
+	s.keys, s.modTime = keys, fi.ModTime()
+
+	return nil
+}
+
+// refresh reloads the file when it changed, a broken file keeps the loaded keys
+func (s *Store) refresh() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if time.Since(s.checked) < refreshInterval {
+		return
+	}
+	s.checked = time.Now()
+
+	fi, err := os.Stat(s.path)
+	if err == nil && fi.ModTime().Equal(s.modTime) {
+		return
+	}
+	if err := s.load(); err != nil {
+		s.modTime = time.Time{}
+	}
+}
+
+// Lookup returns the active key matching the plaintext key
+func (s *Store) Lookup(plain string) (*Key, error) {
+	id, secret, ok := Parse(plain)
+	if !ok {
+		return nil, ErrMalformed
+	}
+
+	s.refresh()
+
+	s.mu.RLock()
+	k, ok := s.keys[id]
+	s.mu.RUnlock()
+
+	if !ok || subtle.ConstantTimeCompare([]byte(k.Hash), []byte(hash(secret))) != 1 {
+		return nil, ErrNotFound
+	}
+
+	switch k.Status(time.Now()) {
+	case "revoked":
+		return nil, ErrRevoked
+	case "expired":
+		return nil, ErrExpired
+	}
+
+	return k, nil
+}
+
+// Create adds a key and returns its plaintext, which is not stored
+func (s *Store) Create(k Key, ttl time.Duration) (string, *Key, error) {
+	id := make([]byte, 6)
+	if _, err := rand.Read(id); err != nil {
+		return "", nil, err
+	}
+	secret, err := random(32)
+	if err != nil {
+		return "", nil, err
+	}
+
+	k.ID = hex.EncodeToString(id)
+	k.Hash = hash(secret)
+	k.CreatedAt = time.Now().UTC()
+	if ttl > 0 {
+		expires := k.CreatedAt.Add(ttl)
+		k.ExpiresAt = &expires
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.keys[k.ID] = &k
+	if err := s.save(); err != nil {
+		delete(s.keys, k.ID)
+		return "", nil, err
+	}
+
+	return Prefix + k.ID + "_" + secret, &k, nil
+}
+
+// Revoke marks a key revoked, it stays listed
+func (s *Store) Revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k, ok := s.keys[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if k.RevokedAt == nil {
+		now := time.Now().UTC()
+		k.RevokedAt = &now
+	}
+
+	return s.save()
+}
+
+// List returns the keys ordered by creation time
+func (s *Store) List() []*Key {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := make([]*Key, 0, len(s.keys))
+	for _, k := range s.keys {
+		list = append(list, k)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+
+	return list
+}
+
+// save writes the file atomically so the server never reads a partial store
+func (s *Store) save() error {
+	list := make([]*Key, 0, len(s.keys))
+	for _, k := range s.keys {
+		list = append(list, k)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+
+	b, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append(b, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// Parse splits a key into its id and secret
+func Parse(plain string) (id, secret string, ok bool) {
+	if !strings.HasPrefix(plain, Prefix) {
+		return "", "", false
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(plain, Prefix), "_", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+
+	return parts[0], parts[1], true
+}
+
+func hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func random(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
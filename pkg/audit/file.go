@@ -0,0 +1,204 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const rotatedTimeFormat = "20060102T150405.000000000"
+
+// FileSink writes JSON lines and rotates the file when it grows past MaxSize.
+// Rotated files are named <path>.<timestamp> so they sort in write order.
+type FileSink struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+	closed     bool
+}
+
+func NewFileSink(path string, maxSize int64, maxBackups int) (*FileSink, error) {
+	s := &FileSink{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *FileSink) Write(rec *Record) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+	if s.maxSize > 0 && s.size+int64(len(b)) > s.maxSize && s.size > 0 {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.file.Write(b)
+	s.size += int64(n)
+	if err != nil {
+		return err
+	}
+
+	return s.file.Sync()
+}
+
+// Last returns the newest record so the chain continues across restarts and rotations
+func (s *FileSink) Last() (*Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	files := append(s.backups(), s.path)
+	for i := len(files) - 1; i >= 0; i-- {
+		rec, err := lastRecord(files[i])
+		if err != nil {
+			return nil, err
+		}
+		if rec != nil {
+			return rec, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.file.Close()
+}
+
+func (s *FileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	s.file = f
+	s.size = info.Size()
+
+	return nil
+}
+
+func (s *FileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+
+	rotated := fmt.Sprintf("%s.%s", s.path, time.Now().UTC().Format(rotatedTimeFormat))
+	if err := os.Rename(s.path, rotated); err != nil {
+		return err
+	}
+
+	if s.maxBackups > 0 {
+		backups := s.backups()
+		for len(backups) > s.maxBackups {
+			if err := os.Remove(backups[0]); err != nil {
+				return err
+			}
+			backups = backups[1:]
+		}
+	}
+
+	return s.open()
+}
+
+// backups lists rotated files, oldest first
+func (s *FileSink) backups() []string {
+	matches, _ := filepath.Glob(s.path + ".*")
+
+	var files []string
+	for _, m := range matches {
+		if _, err := time.Parse(rotatedTimeFormat, strings.TrimPrefix(m, s.path+".")); err == nil {
+			files = append(files, m)
+		}
+	}
+	sort.Strings(files)
+
+	return files
+}
+
+// Files returns the rotated files followed by the current one, in chain order
+func Files(path string) []string {
+	s := &FileSink{path: path}
+	return append(s.backups(), path)
+}
+
+func lastRecord(path string) (*Record, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var last *Record
+	err = scan(f, func(_ int, rec *Record) error {
+		last = rec
+		return nil
+	})
+
+	return last, err
+}
+
+func scan(r io.Reader, fn func(line int, rec *Record) error) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	line := 0
+	for sc.Scan() {
+		line++
+		if len(strings.TrimSpace(sc.Text())) == 0 {
+			continue
+		}
+
+		rec := &Record{}
+		if err := json.Unmarshal(sc.Bytes(), rec); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if err := fn(line, rec); err != nil {
+			return err
+		}
+	}
+
+	return sc.Err()
+}
@@ -0,0 +1,64 @@
+package audit
+
+import (
+	"fmt"
+	"os"
+)
+
+type VerifyResult struct {
+	Records  int
+	FirstSeq uint64
+	LastSeq  uint64
+	// Truncated is set when the first record links to an older one that is no longer present,
+	// which is expected once rotated files are removed
+	Truncated bool
+}
+
+// Verify checks the hash chain over files given in write order
+func Verify(paths []string) (*VerifyResult, error) {
+	var (
+		res  = &VerifyResult{}
+		prev *Record
+	)
+
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return res, err
+		}
+
+		err = scan(f, func(line int, rec *Record) error {
+			if rec.Hash != Hash(rec) {
+				return fmt.Errorf("%s:%d: record %d has been modified", path, line, rec.Seq)
+			}
+
+			if prev == nil {
+				res.FirstSeq = rec.Seq
+				res.Truncated = rec.PrevHash != ""
+			} else {
+				if rec.PrevHash != prev.Hash {
+					return fmt.Errorf("%s:%d: record %d does not link to record %d", path, line, rec.Seq, prev.Seq)
+				}
+				if rec.Seq != prev.Seq+1 {
+					return fmt.Errorf("%s:%d: records %d to %d are missing", path, line, prev.Seq+1, rec.Seq-1)
+				}
+			}
+
+			prev = rec
+			res.Records++
+			res.LastSeq = rec.Seq
+
+			return nil
+		})
+		f.Close()
+
+		if err != nil {
+			return res, err
+		}
+	}
+
+	return res, nil
+}
@@ -0,0 +1,379 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ErrClosed is returned by Write once the sink is closed
+var ErrClosed = errors.New("audit sink is closed")
+
+const (
+	spoolFile     = "spool.jsonl"
+	deliveredFile = "delivered"
+	// spoolCompactSize is the spool size above which a fully delivered spool is cut down to its last record
+	spoolCompactSize = 1 << 20
+
+	minRetry = time.Second
+	maxRetry = time.Minute
+	// drainTimeout bounds the time Close spends sending spooled records
+	drainTimeout = 5 * time.Second
+)
+
+// WebhookSink posts each record as JSON. Records are appended to a spool file in dir before Write returns,
+// so a slow or failing receiver neither adds latency to auth decisions nor loses records: the sender retries
+// with backoff and resumes after a restart from the seq stored in the delivered file. Records are delivered
+// at least once, in order. The spool keeps at least the last record, it is the chain head after a restart.
+type WebhookSink struct {
+	url    string
+	client *http.Client
+	dir    string
+
+	mu     sync.Mutex
+	file   *os.File
+	reader *os.File
+	size   int64
+	last   []byte
+	closed bool
+
+	// offset is the spool position of the next record to send, owned by the sender
+	offset  int64
+	notify  chan struct{}
+	closing chan struct{}
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+func NewWebhookSink(url string, timeout time.Duration, dir string) (*WebhookSink, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+
+	s := &WebhookSink{
+		url:     url,
+		client:  &http.Client{Timeout: timeout},
+		dir:     dir,
+		notify:  make(chan struct{}, 1),
+		closing: make(chan struct{}),
+		stop:    make(chan struct{}),
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+
+	s.wg.Add(1)
+	go s.run()
+
+	return s, nil
+}
+
+// open loads the spool, drops a record torn by a crash and finds the first undelivered record
+func (s *WebhookSink) open() error {
+	delivered, err := s.delivered()
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(s.dir, spoolFile)
+	b, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if i := bytes.LastIndexByte(b, '\n'); i+1 < len(b) {
+		b = b[:i+1]
+		if err := os.Truncate(path, int64(len(b))); err != nil {
+			return err
+		}
+	}
+
+	s.offset = -1
+	var pos int64
+	for _, line := range bytes.SplitAfter(b, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		rec := &Record{}
+		if err := json.Unmarshal(line, rec); err != nil {
+			return fmt.Errorf("audit spool %s: %w", path, err)
+		}
+		if s.offset < 0 && rec.Seq > delivered {
+			s.offset = pos
+		}
+		pos += int64(len(line))
+		s.last = bytes.TrimSuffix(line, []byte("\n"))
+	}
+	if s.offset < 0 {
+		s.offset = pos
+	}
+
+	return s.openFiles(pos)
+}
+
+func (s *WebhookSink) openFiles(size int64) error {
+	path := filepath.Join(s.dir, spoolFile)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	r, err := os.Open(path)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	s.file, s.reader, s.size = f, r, size
+	return nil
+}
+
+// Write appends the record to the spool, it fails once the sink is closed
+func (s *WebhookSink) Write(rec *Record) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+	n, err := s.file.Write(append(b, '\n'))
+	s.size += int64(n)
+	if err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	s.last = b
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// Last returns the newest spooled record so the chain continues across restarts
+func (s *WebhookSink) Last() (*Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.last == nil {
+		return nil, nil
+	}
+	rec := &Record{}
+	if err := json.Unmarshal(s.last, rec); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// Close stops accepting records and sends the spooled ones for up to drainTimeout, until the first
+// failure. The rest is sent after the next start.
+func (s *WebhookSink) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mu.Unlock()
+
+	close(s.closing)
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(drainTimeout):
+		close(s.stop)
+		<-done
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.reader.Close()
+	return s.file.Close()
+}
+
+func (s *WebhookSink) run() {
+	defer s.wg.Done()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+
+		line, err := s.next()
+		if err != nil {
+			log.Error().Err(err).Msg("audit webhook spool")
+			return
+		}
+
+		if line == nil {
+			if err := s.compact(); err != nil {
+				log.Error().Err(err).Msg("audit webhook spool compaction")
+			}
+			select {
+			case <-s.notify:
+				continue
+			case <-s.closing:
+				return
+			}
+		}
+
+		if !s.send(line) {
+			return
+		}
+	}
+}
+
+// next reads the record at offset, nil when every record was sent
+func (s *WebhookSink) next() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.offset >= s.size {
+		return nil, nil
+	}
+	line, err := bufio.NewReader(io.NewSectionReader(s.reader, s.offset, s.size-s.offset)).ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	return line, nil
+}
+
+// send posts the record until the receiver takes it, false when the sink is closing and the post failed
+func (s *WebhookSink) send(line []byte) bool {
+	rec := &Record{}
+	if err := json.Unmarshal(line, rec); err != nil {
+		log.Error().Err(err).Msg("audit webhook spool")
+		return false
+	}
+
+	retry := minRetry
+	for {
+		err := s.post(line)
+		if err == nil {
+			break
+		}
+		log.Error().Err(err).Uint64("seq", rec.Seq).Dur("retry", retry).Msg("audit webhook")
+
+		select {
+		case <-s.closing:
+			return false
+		case <-time.After(retry):
+		}
+		retry = min(2*retry, maxRetry)
+	}
+
+	s.mu.Lock()
+	s.offset += int64(len(line))
+	s.mu.Unlock()
+
+	if err := s.setDelivered(rec.Seq); err != nil {
+		log.Error().Err(err).Uint64("seq", rec.Seq).Msg("audit webhook delivered state")
+	}
+
+	return true
+}
+
+func (s *WebhookSink) post(line []byte) error {
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(line))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// compact cuts a fully delivered spool down to the chain head
+func (s *WebhookSink) compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.size < spoolCompactSize || s.offset < s.size || s.closed {
+		return nil
+	}
+
+	path := filepath.Join(s.dir, spoolFile)
+	head := append(append([]byte(nil), s.last...), '\n')
+	if err := writeFileAtomic(path, head); err != nil {
+		return err
+	}
+
+	s.file.Close()
+	s.reader.Close()
+	if err := s.openFiles(int64(len(head))); err != nil {
+		return err
+	}
+	s.offset = s.size
+
+	return nil
+}
+
+// delivered returns the seq of the last record the receiver took
+func (s *WebhookSink) delivered() (uint64, error) {
+	b, err := os.ReadFile(filepath.Join(s.dir, deliveredFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+}
+
+func (s *WebhookSink) setDelivered(seq uint64) error {
+	return writeFileAtomic(filepath.Join(s.dir, deliveredFile), []byte(strconv.FormatUint(seq, 10)+"\n"))
+}
+
+// writeFileAtomic replaces path, readers see either the old or the new content
+func writeFileAtomic(path string, b []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o640)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
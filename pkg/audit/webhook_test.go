@@ -0,0 +1,137 @@
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"traefik-tower/pkg/decision"
+)
+
+// receiver is a webhook endpoint failing the first fail posts
+type receiver struct {
+	mu      sync.Mutex
+	fail    int
+	records []*Record
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.fail > 0 {
+		r.fail--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	rec := &Record{}
+	if err := json.NewDecoder(req.Body).Decode(rec); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	r.records = append(r.records, rec)
+}
+
+// wait returns the seqs received once there are n of them
+func (r *receiver) wait(t *testing.T, n int) []uint64 {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		r.mu.Lock()
+		var seqs []uint64
+		for _, rec := range r.records {
+			seqs = append(seqs, rec.Seq)
+		}
+		r.mu.Unlock()
+
+		if len(seqs) >= n || time.Now().After(deadline) {
+			return seqs
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func logN(t *testing.T, a *Auditor, n int) {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		if err := a.Log(&decision.Record{Start: time.Now(), Method: http.MethodGet, Outcome: decision.OutcomeAllow}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWebhookSinkRetries(t *testing.T) {
+	r := &receiver{fail: 1}
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	sink, err := NewWebhookSink(srv.URL, time.Second, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewAuditor(sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	logN(t, a, 3)
+
+	if seqs, want := r.wait(t, 3), []uint64{1, 2, 3}; !reflect.DeepEqual(seqs, want) {
+		t.Errorf("delivered seqs = %v, want %v", seqs, want)
+	}
+}
+
+func TestWebhookSinkResumes(t *testing.T) {
+	dir := t.TempDir()
+
+	down := &receiver{fail: 1 << 30}
+	srv := httptest.NewServer(down)
+	sink, err := NewWebhookSink(srv.URL, time.Second, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewAuditor(sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logN(t, a, 2)
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	srv.Close()
+
+	if err := sink.Write(&Record{Seq: 3}); !errors.Is(err, ErrClosed) {
+		t.Errorf("Write after Close = %v, want %v", err, ErrClosed)
+	}
+
+	up := &receiver{}
+	srv = httptest.NewServer(up)
+	defer srv.Close()
+	sink, err = NewWebhookSink(srv.URL, time.Second, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err = NewAuditor(sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	logN(t, a, 1)
+
+	if seqs, want := up.wait(t, 3), []uint64{1, 2, 3}; !reflect.DeepEqual(seqs, want) {
+		t.Fatalf("delivered seqs = %v, want %v", seqs, want)
+	}
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	if up.records[2].PrevHash != up.records[1].Hash {
+		t.Errorf("chain broken across restart: prev_hash %q, want %q", up.records[2].PrevHash, up.records[1].Hash)
+	}
+}
@@ -0,0 +1,118 @@
+package cache
+
+import (
+	"sync"
+	"time"
+
+	"traefik-tower/pkg/metrics"
+)
+
+// Cache is a size bounded in-memory cache with an expiry per entry.
+// A nil Cache or one of size 0 caches nothing.
+type Cache struct {
+	name    string
+	size    int
+	mu      sync.Mutex
+	entries map[string]entry
+}
+
+type entry struct {
+	value  interface{}
+	expiry time.Time
+}
+
+// New returns a cache holding up to size entries, name labels its metrics
+func New(name string, size int) *Cache {
+	return &Cache{
+		name:    name,
+		size:    size,
+		entries: map[string]entry{},
+	}
+}
+
+// Get returns a value that has not expired yet
+func (c *Cache) Get(key string) (interface{}, bool) {
+	if c == nil || c.size <= 0 {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if ok && time.Now().After(e.expiry) {
+		c.delete(key)
+		ok = false
+	}
+	metrics.CacheLookup(c.name, ok)
+
+	return e.value, ok
+}
+
+// Set stores value until expiry, making room by dropping expired and then arbitrary entries
+func (c *Cache) Set(key string, value interface{}, expiry time.Time) {
+	if c == nil || c.size <= 0 || !time.Now().Before(expiry) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.size {
+		c.evict()
+	}
+	if _, ok := c.entries[key]; !ok {
+		metrics.CacheEntries.WithLabelValues(c.name).Inc()
+	}
+	c.entries[key] = entry{value: value, expiry: expiry}
+}
+
+// Delete drops a key, e.g. once the upstream rejected it
+func (c *Cache) Delete(key string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.delete(key)
+}
+
+// Close drops all entries, e.g. once a reload replaced the cache
+func (c *Cache) Close() error {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for k := range c.entries {
+		c.delete(k)
+	}
+	return nil
+}
+
+func (c *Cache) delete(key string) {
+	if _, ok := c.entries[key]; ok {
+		delete(c.entries, key)
+		metrics.CacheEntries.WithLabelValues(c.name).Dec()
+	}
+}
+
+func (c *Cache) evict() {
+	now := time.Now()
+	for k, e := range c.entries {
+		if now.After(e.expiry) {
+			c.delete(k)
+		}
+	}
+
+	for k := range c.entries {
+		if len(c.entries) < c.size {
+			return
+		}
+		c.delete(k)
+	}
+}
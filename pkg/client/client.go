@@ -9,9 +9,10 @@ import (
 	"net/url"
 
 	"net/http"
-	"net/http/httputil"
 
 	"github.com/rs/zerolog/log"
+
+	"traefik-tower/pkg/redact"
 )
 
 func NewClient(basePath string) (*HTTPClient, error) {
@@ -86,7 +87,7 @@ func (c *HTTPClient) NewRequest(method, uPath string, payload io.Reader) (*http.
 	return http.NewRequest(method, uPath, payload)
 }
 
-// log will dump request and response to the log file
+// log will dump request and response to the log file, credentials are masked
 func (c *HTTPClient) printLog(r *http.Request, resp *http.Response) {
 	var (
 		reqDump  string
@@ -94,10 +95,10 @@ func (c *HTTPClient) printLog(r *http.Request, resp *http.Response) {
 	)
 
 	if r != nil {
-		reqDump = fmt.Sprintf("%s %s. Data: %s", r.Method, r.URL.String(), r.Form.Encode())
+		reqDump = fmt.Sprintf("%s %s. Data: %s", r.Method, redact.URL(r.URL), redact.Values(r.Form).Encode())
 	}
 	if resp != nil {
-		respDump, _ = httputil.DumpResponse(resp, true)
+		respDump, _ = redact.DumpResponse(resp, true)
 	}
 
 	log.Debug().Msgf(fmt.Sprintf("request: %s\n response: %s\n", reqDump, string(respDump)))
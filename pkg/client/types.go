@@ -9,6 +9,10 @@ const (
 	ClientsIDHydraPath        = "/clients/{id}"
 	UserInfoCognitoPath       = "/oauth2/userInfo"
 	KetoEnginesAcpGlobAllowed = "/engines/acp/ory/glob/allowed"
+	KetoPoliciesPath          = "/engines/acp/ory/{flavor}/policies"
+	KetoRolesPath             = "/engines/acp/ory/{flavor}/roles"
+	OPADataPath               = "/v1/data/"
+	KratosWhoamiPath          = "/sessions/whoami"
 )
 
 type (
@@ -0,0 +1,278 @@
+package decision
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+type Outcome string
+
+const (
+	OutcomeAllow Outcome = "allow"
+	OutcomeDeny  Outcome = "deny"
+	OutcomeError Outcome = "error"
+)
+
+// Reasons are kept to a small fixed set so they can be used as metric labels
+const (
+	ReasonOK             = "ok"
+	ReasonMissingToken   = "missing_token"
+	ReasonInactiveToken  = "inactive_token"
+	ReasonUnknownClient  = "unknown_client"
+	ReasonPolicyDenied   = "policy_denied"
+	ReasonNotConfigured  = "not_configured"
+	ReasonUpstreamError  = "upstream_error"
+	ReasonInternalError  = "internal_error"
+	ReasonUnknownSubject = "unknown_subject"
+	ReasonRoleDenied     = "role_denied"
+	ReasonUnknownIssuer  = "unknown_issuer"
+	ReasonRouteDenied    = "route_denied"
+	ReasonThrottled      = "throttled"
+	ReasonRateLimited    = "rate_limited"
+	ReasonIPDenied       = "ip_denied"
+)
+
+// Stages of the auth pipeline
+const (
+	StageIntrospect    = "introspect"
+	StageClientLookup  = "client_lookup"
+	StageKeto          = "keto"
+	StageCognito       = "cognito"
+	StageCognitoAWS    = "cognito_aws"
+	StageKratos        = "kratos"
+	StageAPIKey        = "api_key"
+	StageMTLS          = "mtls"
+	StageBasic         = "basic"
+	StageLDAP          = "ldap"
+	StageACP           = "acp"
+	StageOPA           = "opa"
+	StageRateLimit     = "rate_limit"
+	StageClientIP      = "client_ip"
+	StageRoute         = "route"
+	StageRoles         = "roles"
+	UpstreamHydra      = "hydra"
+	UpstreamKeto       = "keto"
+	UpstreamCognito    = "cognito"
+	UpstreamCognitoAWS = "cognito_aws"
+	UpstreamKratos     = "kratos"
+	UpstreamLDAP       = "ldap"
+	UpstreamOPA        = "opa"
+)
+
+type Stage struct {
+	Name     string
+	Duration time.Duration
+}
+
+type Upstream struct {
+	Name   string
+	Status int
+}
+
+// Record collects everything known about a single auth decision
+type Record struct {
+	AuthType  string
+	Tenant    string
+	Route     string
+	RequestID string
+	TraceID   string
+	TokenHash string
+	// forwarded request attributes
+	Method   string
+	Host     string
+	URI      string
+	ClientIP string
+
+	Start      time.Time
+	End        time.Time
+	Status     int
+	ConsumerID string
+	// Role is Roles joined by commas
+	Role  string
+	Roles []string
+	// Pool is the identity pool the consumer was authenticated against
+	Pool      string
+	Outcome   Outcome
+	Reason    string
+	Stages    []Stage
+	Upstreams []Upstream
+
+	// Claims and ClientMetadata describe the identity to authorizers, they are not logged
+	Claims         map[string]interface{}
+	ClientMetadata map[string]interface{}
+
+	// Explain is set for dry runs, see NewExplainContext
+	Explain *Explain
+}
+
+// Explain collects the inputs and outputs of every stage of a dry run. Dry runs bypass caches and
+// failure counters and are not exported to metrics, the access log or the audit log.
+type Explain struct {
+	Record *Record
+	Steps  []Step
+	// Error is the error of a failed decision
+	Error string
+}
+
+// Step is the input and output of one stage, values must not hold credentials
+type Step struct {
+	Stage  string      `json:"stage"`
+	Input  interface{} `json:"input,omitempty"`
+	Output interface{} `json:"output,omitempty"`
+}
+
+type explainCtxKey struct{}
+
+// NewExplainContext marks the requests run with ctx as dry runs collected into ex
+func NewExplainContext(ctx context.Context, ex *Explain) context.Context {
+	return context.WithValue(ctx, explainCtxKey{}, ex)
+}
+
+func ExplainFromContext(ctx context.Context) *Explain {
+	ex, _ := ctx.Value(explainCtxKey{}).(*Explain)
+	return ex
+}
+
+// Capture hands the record of a request to the middleware in front of the auth handler, e.g. the
+// browser login deciding whether a 401 asks for a new login
+type Capture struct {
+	Record *Record
+}
+
+type captureCtxKey struct{}
+
+func NewCaptureContext(ctx context.Context, c *Capture) context.Context {
+	return context.WithValue(ctx, captureCtxKey{}, c)
+}
+
+func CaptureFromContext(ctx context.Context) *Capture {
+	c, _ := ctx.Value(captureCtxKey{}).(*Capture)
+	return c
+}
+
+type ctxKey struct{}
+
+func New(authType string) *Record {
+	return &Record{
+		AuthType: authType,
+		Start:    time.Now(),
+	}
+}
+
+func NewContext(ctx context.Context, rec *Record) context.Context {
+	return context.WithValue(ctx, ctxKey{}, rec)
+}
+
+// FromContext returns the record stored in ctx; all Record methods are safe to call on nil
+func FromContext(ctx context.Context) *Record {
+	rec, _ := ctx.Value(ctxKey{}).(*Record)
+	return rec
+}
+
+// DryRun reports whether the decision is only explained
+func (r *Record) DryRun() bool {
+	return r != nil && r.Explain != nil
+}
+
+// Step adds the input and output of a stage to the explanation of a dry run
+func (r *Record) Step(stage string, input, output interface{}) {
+	if !r.DryRun() {
+		return
+	}
+	r.Explain.Steps = append(r.Explain.Steps, Step{Stage: stage, Input: input, Output: output})
+}
+
+// ObserveStage records the time passed since start, intended to be deferred
+func (r *Record) ObserveStage(name string, start time.Time) {
+	if r == nil {
+		return
+	}
+	r.Stages = append(r.Stages, Stage{Name: name, Duration: time.Since(start)})
+}
+
+// ObserveUpstream records the status code of an upstream call, 0 if the call itself failed
+func (r *Record) ObserveUpstream(name string, status int) {
+	if r == nil {
+		return
+	}
+	r.Upstreams = append(r.Upstreams, Upstream{Name: name, Status: status})
+}
+
+// SetReason keeps the first reason given, which is the closest to the cause
+func (r *Record) SetReason(reason string) {
+	if r == nil || r.Reason != "" {
+		return
+	}
+	r.Reason = reason
+}
+
+func (r *Record) SetRole(role string) {
+	if r == nil {
+		return
+	}
+	r.Role = role
+	r.Roles = nil
+	if role != "" {
+		r.Roles = []string{role}
+	}
+}
+
+// SetRoles is SetRole for consumers with several roles
+func (r *Record) SetRoles(roles []string) {
+	if r == nil {
+		return
+	}
+	r.Roles = roles
+	r.Role = strings.Join(roles, ",")
+}
+
+func (r *Record) Allow(consumerID string) {
+	if r == nil {
+		return
+	}
+	r.ConsumerID = consumerID
+	r.Outcome = OutcomeAllow
+	r.Reason = ReasonOK
+}
+
+func (r *Record) Deny() {
+	if r == nil {
+		return
+	}
+	r.Outcome = OutcomeDeny
+	r.SetReason(ReasonPolicyDenied)
+}
+
+func (r *Record) Fail() {
+	if r == nil {
+		return
+	}
+	r.Outcome = OutcomeError
+	r.SetReason(ReasonInternalError)
+}
+
+func (r *Record) SetStatus(status int) {
+	if r == nil {
+		return
+	}
+	r.Status = status
+}
+
+// Finish freezes the decision duration
+func (r *Record) Finish() {
+	if r == nil || !r.End.IsZero() {
+		return
+	}
+	r.End = time.Now()
+}
+
+func (r *Record) Took() time.Duration {
+	if r == nil {
+		return 0
+	}
+	if r.End.IsZero() {
+		return time.Since(r.Start)
+	}
+	return r.End.Sub(r.Start)
+}
@@ -0,0 +1,246 @@
+package extauthz
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/peer"
+
+	"traefik-tower/pkg/forward"
+)
+
+// ContextExtensionTenant selects a tenant profile from the Envoy ext_authz filter config,
+// the same as pointing forwardAuth at /t/{tenant}
+const ContextExtensionTenant = "tenant"
+
+// Server implements envoy.service.auth.v3.Authorization. Check requests are turned into forward auth
+// requests and served by the HTTP handler, so both ingresses share tenants, routes and the auth pipeline.
+type Server struct {
+	handler http.Handler
+	grpc    *grpc.Server
+}
+
+// NewServer serves plain gRPC when tlsConfig is nil
+func NewServer(handler http.Handler, tlsConfig *tls.Config) *Server {
+	var opts []grpc.ServerOption
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+
+	s := &Server{
+		handler: handler,
+		grpc:    grpc.NewServer(opts...),
+	}
+
+	authv3.RegisterAuthorizationServer(s.grpc, s)
+	healthpb.RegisterHealthServer(s.grpc, health.NewServer())
+
+	return s
+}
+
+// TLSConfig loads the server certificate, client certificates are required and verified against
+// clientCAFile when it is set
+func TLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if clientCAFile != "" {
+		b, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		c.ClientCAs = x509.NewCertPool()
+		if !c.ClientCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("ext_authz client ca file %s: no certificates", clientCAFile)
+		}
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return c, nil
+}
+
+func (s *Server) Serve(l net.Listener) error {
+	return s.grpc.Serve(l)
+}
+
+// Shutdown waits for in-flight checks until ctx is done
+func (s *Server) Shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.grpc.GracefulStop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.grpc.Stop()
+		return ctx.Err()
+	}
+}
+
+// Check runs the forward auth handler and returns its headers to add upstream or its denial response
+func (s *Server) Check(ctx context.Context, check *authv3.CheckRequest) (*authv3.CheckResponse, error) {
+	req, err := forwardRequest(ctx, check)
+	if err != nil {
+		return nil, err
+	}
+
+	rw := newResponseWriter()
+	s.handler.ServeHTTP(rw, req)
+
+	if rw.status == http.StatusOK {
+		return &authv3.CheckResponse{
+			Status: &status.Status{Code: int32(codes.OK)},
+			HttpResponse: &authv3.CheckResponse_OkResponse{
+				OkResponse: &authv3.OkHttpResponse{
+					Headers: headerOptions(rw.header, "Content-Type", "Content-Length"),
+				},
+			},
+		}, nil
+	}
+
+	return &authv3.CheckResponse{
+		Status: &status.Status{Code: int32(grpcCode(rw.status))},
+		HttpResponse: &authv3.CheckResponse_DeniedResponse{
+			DeniedResponse: &authv3.DeniedHttpResponse{
+				Status:  &typev3.HttpStatus{Code: typev3.StatusCode(rw.status)},
+				Headers: headerOptions(rw.header, "Content-Length"),
+				Body:    rw.body.String(),
+			},
+		},
+	}, nil
+}
+
+// forwardRequest builds the request Traefik would send for the checked request
+func forwardRequest(ctx context.Context, check *authv3.CheckRequest) (*http.Request, error) {
+	attrs := check.GetAttributes()
+	hr := attrs.GetRequest().GetHttp()
+
+	path := "/"
+	if tenant := attrs.GetContextExtensions()[ContextExtensionTenant]; tenant != "" {
+		path = "/t/" + url.PathEscape(tenant)
+	}
+
+	// envoy describes the original request itself, the source is the downstream client as envoy saw it
+	fr := &forward.Request{
+		Method: hr.GetMethod(),
+		Host:   hr.GetHost(),
+		URI:    hr.GetPath(),
+		Proto:  hr.GetScheme(),
+		// url encoded PEM of the downstream certificate when envoy terminates mTLS
+		ClientCert: attrs.GetSource().GetCertificate(),
+	}
+	if sa := attrs.GetSource().GetAddress().GetSocketAddress(); sa != nil {
+		fr.ClientIP = sa.GetAddress()
+	}
+
+	req, err := http.NewRequestWithContext(forward.NewContext(ctx, fr), http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// the forward handler trusts the source only when the peer is a trusted proxy
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		req.RemoteAddr = p.Addr.String()
+	}
+
+	for k, v := range hr.GetHeaders() {
+		// pseudo headers are described by the forward request
+		if strings.HasPrefix(k, ":") {
+			continue
+		}
+		req.Header.Set(k, v)
+	}
+
+	if req.Header.Get("X-Request-Id") == "" && hr.GetId() != "" {
+		req.Header.Set("X-Request-Id", hr.GetId())
+	}
+
+	return req, nil
+}
+
+// headerOptions overwrites headers of the same name, so clients can not spoof the consumer headers
+func headerOptions(h http.Header, skip ...string) []*corev3.HeaderValueOption {
+	skipped := map[string]bool{}
+	for _, k := range skip {
+		skipped[k] = true
+	}
+
+	var opts []*corev3.HeaderValueOption
+	for k, values := range h {
+		if skipped[k] {
+			continue
+		}
+		for _, v := range values {
+			opts = append(opts, &corev3.HeaderValueOption{
+				Header:       &corev3.HeaderValue{Key: k, Value: v},
+				AppendAction: corev3.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD,
+			})
+		}
+	}
+
+	return opts
+}
+
+func grpcCode(httpStatus int) codes.Code {
+	switch {
+	case httpStatus == http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case httpStatus == http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case httpStatus >= http.StatusInternalServerError:
+		return codes.Unavailable
+	default:
+		return codes.PermissionDenied
+	}
+}
+
+// responseWriter keeps the forward auth response in memory
+type responseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newResponseWriter() *responseWriter {
+	return &responseWriter{header: http.Header{}}
+}
+
+func (w *responseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(b)
+}
@@ -0,0 +1,261 @@
+package forward
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Headers carrying the original request, in order of precedence. Traefik and Caddy forward auth send
+// X-Forwarded-*, nginx auth_request and HAProxy setups commonly send X-Original-* and X-Real-Ip.
+var (
+	MethodHeaders = []string{"X-Forwarded-Method", "X-Original-Method"}
+	HostHeaders   = []string{"X-Forwarded-Host", "X-Original-Host"}
+	URIHeaders    = []string{"X-Forwarded-Uri", "X-Original-Uri", "X-Original-Url"}
+	ProtoHeaders  = []string{"X-Forwarded-Proto", "X-Forwarded-Scheme", "X-Scheme"}
+	// ClientCertHeaders carry the TLS client certificate, e.g. Traefik passTLSClientCert
+	// or nginx $ssl_client_escaped_cert
+	ClientCertHeaders = []string{"X-Forwarded-Tls-Client-Cert", "X-Ssl-Client-Cert", "X-Client-Cert"}
+)
+
+const (
+	HeaderForwarded     = "Forwarded"
+	HeaderXForwardedFor = "X-Forwarded-For"
+	HeaderXRealIP       = "X-Real-Ip"
+)
+
+// Request holds the attributes of the original request the proxy asks about
+type Request struct {
+	Method   string
+	Host     string
+	URI      string
+	Proto    string
+	ClientIP string
+	// ClientCert is the forwarded client certificate, only set by trusted proxies
+	ClientCert string
+}
+
+type ctxKey struct{}
+
+func NewContext(ctx context.Context, r *Request) context.Context {
+	return context.WithValue(ctx, ctxKey{}, r)
+}
+
+// FromContext returns the normalized request, an empty one when the request was not normalized
+func FromContext(ctx context.Context) *Request {
+	if r, ok := ctx.Value(ctxKey{}).(*Request); ok {
+		return r
+	}
+	return &Request{}
+}
+
+// Normalizer reads the original request from the headers of trusted proxies
+type Normalizer struct {
+	trusted []*net.IPNet
+}
+
+// NewNormalizer accepts IPs and CIDRs. Without trusted proxies every peer is trusted,
+// the tower is then expected to be reachable only by its proxies. The client ip and client
+// certificates are only read from proxies listed as trusted.
+func NewNormalizer(trustedProxies []string) (*Normalizer, error) {
+	n := &Normalizer{}
+	for _, p := range trustedProxies {
+		ipNet, err := ParseCIDR(p)
+		if err != nil {
+			return nil, err
+		}
+		n.trusted = append(n.trusted, ipNet)
+	}
+
+	return n, nil
+}
+
+// ParseCIDR parses a CIDR or a single IP
+func ParseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("%q is not an IP or CIDR", s)
+		}
+		bits := 8 * net.IPv4len
+		if ip.To4() == nil {
+			bits = 8 * net.IPv6len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("%q is not an IP or CIDR", s)
+	}
+
+	return ipNet, nil
+}
+
+func (n *Normalizer) isTrusted(ip net.IP) bool {
+	if len(n.trusted) == 0 {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range n.trusted {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Normalize describes the original request. Headers of untrusted peers are ignored,
+// their request is taken as the original one.
+func (n *Normalizer) Normalize(req *http.Request) *Request {
+	peer := remoteIP(req.RemoteAddr)
+
+	if !n.isTrusted(net.ParseIP(peer)) {
+		return &Request{
+			Method:   req.Method,
+			Host:     req.Host,
+			URI:      req.RequestURI,
+			Proto:    requestProto(req),
+			ClientIP: peer,
+		}
+	}
+
+	fwd := parseForwarded(req.Header.Get(HeaderForwarded))
+
+	return &Request{
+		Method:   firstHeader(req.Header, MethodHeaders),
+		Host:     firstOf(firstHeader(req.Header, HostHeaders), fwd["host"]),
+		URI:      firstHeader(req.Header, URIHeaders),
+		Proto:    strings.ToLower(firstOf(firstHeader(req.Header, ProtoHeaders), fwd["proto"])),
+		ClientIP: n.clientIP(req, peer),
+
+		ClientCert: n.clientCert(req),
+	}
+}
+
+// FromPeer checks a request described by another front end, e.g. the ext_authz server, against the
+// address of the peer that sent it. Unless the peer is a trusted proxy its client certificate is
+// dropped and the peer is taken as the client ip.
+func (n *Normalizer) FromPeer(r *Request, remoteAddr string) *Request {
+	peer := remoteIP(remoteAddr)
+	if len(n.trusted) > 0 && n.isTrusted(net.ParseIP(peer)) {
+		return r
+	}
+
+	untrusted := *r
+	untrusted.ClientIP = peer
+	untrusted.ClientCert = ""
+	return &untrusted
+}
+
+// clientCert reads the forwarded client certificate, only proxies listed as trusted may send one
+func (n *Normalizer) clientCert(req *http.Request) string {
+	if len(n.trusted) == 0 {
+		return ""
+	}
+	return firstHeader(req.Header, ClientCertHeaders)
+}
+
+// clientIP walks the proxy chain from the peer and returns the first untrusted address. Without
+// trusted proxies it is the peer, any hop of the chain could have been set by the client.
+func (n *Normalizer) clientIP(req *http.Request, peer string) string {
+	if len(n.trusted) == 0 {
+		return peer
+	}
+
+	var chain []string
+	for _, v := range req.Header.Values(HeaderXForwardedFor) {
+		for _, ip := range strings.Split(v, ",") {
+			if ip = strings.TrimSpace(ip); ip != "" {
+				chain = append(chain, ip)
+			}
+		}
+	}
+	if len(chain) == 0 {
+		if ip := parseForwarded(req.Header.Get(HeaderForwarded))["for"]; ip != "" {
+			chain = append(chain, remoteIP(ip))
+		} else if ip := strings.TrimSpace(req.Header.Get(HeaderXRealIP)); ip != "" {
+			chain = append(chain, ip)
+		}
+	}
+
+	for i := len(chain) - 1; i >= 0; i-- {
+		if !n.isTrusted(net.ParseIP(chain[i])) {
+			return chain[i]
+		}
+	}
+	if len(chain) > 0 {
+		return chain[0]
+	}
+
+	return peer
+}
+
+// Handler normalizes the request once before tenant selection and the auth handlers
+func Handler(n *Normalizer, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// set by other front ends, e.g. the ext_authz server, with the peer as remote address
+		if r, ok := req.Context().Value(ctxKey{}).(*Request); ok {
+			req = req.WithContext(NewContext(req.Context(), n.FromPeer(r, req.RemoteAddr)))
+		} else {
+			req = req.WithContext(NewContext(req.Context(), n.Normalize(req)))
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// parseForwarded reads the first element of an RFC 7239 Forwarded header
+func parseForwarded(v string) map[string]string {
+	params := map[string]string{}
+	if v == "" {
+		return params
+	}
+
+	first := strings.Split(v, ",")[0]
+	for _, pair := range strings.Split(first, ";") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		params[strings.ToLower(kv[0])] = strings.Trim(kv[1], `"`)
+	}
+
+	return params
+}
+
+func firstHeader(h http.Header, names []string) string {
+	for _, name := range names {
+		if v := h.Get(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func firstOf(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// remoteIP strips the port and the brackets of IPv6 addresses
+func remoteIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.Trim(addr, "[]")
+}
+
+func requestProto(req *http.Request) string {
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
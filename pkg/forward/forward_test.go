@@ -0,0 +1,163 @@
+package forward
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+const cert = "-----BEGIN%20CERTIFICATE-----"
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted []string
+		peer    string
+		headers map[string]string
+		want    *Request
+	}{
+		{
+			name:    "trusted proxy",
+			trusted: []string{"10.0.0.0/8"},
+			peer:    "10.0.0.1:4321",
+			headers: map[string]string{
+				"X-Forwarded-Method": "POST",
+				"X-Forwarded-Host":   "app.example.com",
+				"X-Forwarded-Uri":    "/api?q=1",
+				"X-Forwarded-Proto":  "HTTPS",
+				"X-Forwarded-For":    "203.0.113.7",
+				"X-Ssl-Client-Cert":  cert,
+			},
+			want: &Request{
+				Method: "POST", Host: "app.example.com", URI: "/api?q=1", Proto: "https",
+				ClientIP: "203.0.113.7", ClientCert: cert,
+			},
+		},
+		{
+			name:    "spoofed x-forwarded-for, the rightmost untrusted hop wins",
+			trusted: []string{"10.0.0.0/8"},
+			peer:    "10.0.0.1:4321",
+			headers: map[string]string{"X-Forwarded-For": "10.8.0.1, 203.0.113.7, 10.0.0.2"},
+			want:    &Request{ClientIP: "203.0.113.7"},
+		},
+		{
+			name:    "chain of trusted proxies only",
+			trusted: []string{"10.0.0.0/8"},
+			peer:    "10.0.0.1:4321",
+			headers: map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"},
+			want:    &Request{ClientIP: "10.0.0.3"},
+		},
+		{
+			name:    "forwarded header fallback",
+			trusted: []string{"10.0.0.0/8"},
+			peer:    "10.0.0.1:4321",
+			headers: map[string]string{"Forwarded": `for="[2001:db8::1]:80";host=app.example.com;proto=https`},
+			want:    &Request{Host: "app.example.com", Proto: "https", ClientIP: "2001:db8::1"},
+		},
+		{
+			name:    "x-real-ip fallback",
+			trusted: []string{"10.0.0.1"},
+			peer:    "10.0.0.1:4321",
+			headers: map[string]string{"X-Real-Ip": "203.0.113.7", "X-Original-Uri": "/nginx"},
+			want:    &Request{URI: "/nginx", ClientIP: "203.0.113.7"},
+		},
+		{
+			name:    "trusted proxy without forwarded client",
+			trusted: []string{"10.0.0.0/8"},
+			peer:    "10.0.0.1:4321",
+			want:    &Request{ClientIP: "10.0.0.1"},
+		},
+		{
+			name:    "untrusted peer headers are ignored",
+			trusted: []string{"10.0.0.0/8"},
+			peer:    "203.0.113.7:4321",
+			headers: map[string]string{
+				"X-Forwarded-Uri":             "/admin",
+				"X-Forwarded-For":             "10.8.0.1",
+				"X-Forwarded-Tls-Client-Cert": cert,
+			},
+			want: &Request{Method: http.MethodGet, Host: "example.com", URI: "/", Proto: "http", ClientIP: "203.0.113.7"},
+		},
+		{
+			name:    "no trusted proxies, the peer is the client and certificates are dropped",
+			peer:    "10.0.0.1:4321",
+			headers: map[string]string{"X-Forwarded-Uri": "/api", "X-Forwarded-For": "10.8.0.1", "X-Client-Cert": cert},
+			want:    &Request{URI: "/api", ClientIP: "10.0.0.1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, err := NewNormalizer(tt.trusted)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.peer
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+
+			if got := n.Normalize(req); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Normalize() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFromPeer(t *testing.T) {
+	reported := &Request{Method: "GET", Host: "app.example.com", URI: "/", ClientIP: "10.8.0.1", ClientCert: cert}
+
+	tests := []struct {
+		name    string
+		trusted []string
+		peer    string
+		want    *Request
+	}{
+		{name: "trusted peer", trusted: []string{"10.0.0.0/8"}, peer: "10.0.0.1:4321", want: reported},
+		{
+			name:    "untrusted peer",
+			trusted: []string{"10.0.0.0/8"},
+			peer:    "203.0.113.7:4321",
+			want:    &Request{Method: "GET", Host: "app.example.com", URI: "/", ClientIP: "203.0.113.7"},
+		},
+		{
+			name: "no trusted proxies",
+			peer: "10.0.0.1:4321",
+			want: &Request{Method: "GET", Host: "app.example.com", URI: "/", ClientIP: "10.0.0.1"},
+		},
+		{
+			name:    "unknown peer",
+			trusted: []string{"10.0.0.0/8"},
+			want:    &Request{Method: "GET", Host: "app.example.com", URI: "/"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, err := NewNormalizer(tt.trusted)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := n.FromPeer(reported, tt.peer); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("FromPeer() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCIDR(t *testing.T) {
+	for _, s := range []string{"10.0.0.1", "10.0.0.0/8", "2001:db8::1", "2001:db8::/32"} {
+		if _, err := ParseCIDR(s); err != nil {
+			t.Errorf("ParseCIDR(%q) = %v", s, err)
+		}
+	}
+	for _, s := range []string{"", "10.0.0", "10.0.0.0/33", "example.com"} {
+		if _, err := ParseCIDR(s); err == nil {
+			t.Errorf("ParseCIDR(%q) accepted", s)
+		}
+	}
+}
@@ -29,6 +29,20 @@ type Shutdowner interface {
 	Shutdown(ctx context.Context) error
 }
 
+// Shutdowners shuts down several servers on the same signal
+type Shutdowners []Shutdowner
+
+func (ss Shutdowners) Shutdown(ctx context.Context) error {
+	var firstErr error
+	for _, s := range ss {
+		if err := s.Shutdown(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
 // Logger is implemented by *log.Logger
 type Logger interface {
 	Printf(format string, v ...interface{})
@@ -94,8 +108,9 @@ func ListenAndServeTLS(s TLSServer, certFile, keyFile string) {
 	Shutdown(s)
 }
 
-// Shutdown blocks until os.Interrupt or syscall.SIGTERM received, then
-// running *http.Server.Shutdown with a context having a timeout
+// Shutdown blocks until os.Interrupt, syscall.SIGTERM or syscall.SIGQUIT received, then
+// running *http.Server.Shutdown with a context having a timeout.
+// syscall.SIGHUP is left for config reload.
 func Shutdown(s Shutdowner) {
 	signals = make(chan os.Signal, 1)
 
@@ -104,7 +119,6 @@ func Shutdown(s Shutdowner) {
 		os.Interrupt,
 		syscall.SIGTERM,
 		syscall.SIGINT,
-		syscall.SIGHUP,
 		syscall.SIGQUIT)
 
 	<-signals
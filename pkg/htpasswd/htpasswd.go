@@ -0,0 +1,234 @@
+package htpasswd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1" // nolint: gosec
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// refreshInterval limits how often the files are checked for changes
+const refreshInterval = time.Second
+
+// dummyHash is compared for unknown users so they take as long as known ones
+var dummyHash = []byte("$2a$10$jwgQJa0gQt1eJp0uHxnNHuQ7t1wX53QHm4/BWxPfSxv2I9.Or/VOG")
+
+// File authenticates users of an htpasswd file with bcrypt, {SHA} and $apr1$ hashes. Groups are read from
+// an optional Apache group file with lines like "admins: alice bob". Both files are reloaded when they change.
+type File struct {
+	path      string
+	groupPath string
+
+	mu         sync.RWMutex
+	users      map[string]string
+	groups     map[string][]string
+	modTime    time.Time
+	groupMTime time.Time
+
+	// checking is held by the request checking the files, checked is the unix nano time of the last check
+	checking sync.Mutex
+	checked  atomic.Int64
+}
+
+// Open loads the htpasswd file and the group file when groupPath is set
+func Open(path, groupPath string) (*File, error) {
+	f := &File{path: path, groupPath: groupPath}
+	if err := f.loadUsers(); err != nil {
+		return nil, err
+	}
+	if err := f.loadGroups(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (f *File) loadUsers() error {
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	b, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+
+	users, err := Parse(b)
+	if err != nil {
+		return fmt.Errorf("htpasswd file %s: %w", f.path, err)
+	}
+	f.users, f.modTime = users, fi.ModTime()
+
+	return nil
+}
+
+func (f *File) loadGroups() error {
+	if f.groupPath == "" {
+		f.groups = map[string][]string{}
+		return nil
+	}
+
+	fi, err := os.Stat(f.groupPath)
+	if err != nil {
+		return err
+	}
+	b, err := os.ReadFile(f.groupPath)
+	if err != nil {
+		return err
+	}
+
+	groups, err := ParseGroups(b)
+	if err != nil {
+		return fmt.Errorf("group file %s: %w", f.groupPath, err)
+	}
+	f.groups, f.groupMTime = groups, fi.ModTime()
+
+	return nil
+}
+
+// refresh reloads changed files, a broken or missing file keeps the loaded users and groups.
+// One request at a time checks the files, the others go on with the loaded ones.
+func (f *File) refresh() {
+	if time.Since(time.Unix(0, f.checked.Load())) < refreshInterval || !f.checking.TryLock() {
+		return
+	}
+	defer f.checking.Unlock()
+	f.checked.Store(time.Now().UnixNano())
+
+	f.mu.RLock()
+	usersChanged := changed(f.path, f.modTime)
+	groupsChanged := f.groupPath != "" && changed(f.groupPath, f.groupMTime)
+	f.mu.RUnlock()
+	if !usersChanged && !groupsChanged {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if usersChanged {
+		if err := f.loadUsers(); err != nil {
+			log.Error().Err(err).Msg("htpasswd reload")
+		}
+	}
+	if groupsChanged {
+		if err := f.loadGroups(); err != nil {
+			log.Error().Err(err).Msg("htpasswd group reload")
+		}
+	}
+}
+
+func changed(path string, modTime time.Time) bool {
+	fi, err := os.Stat(path)
+	return err == nil && !fi.ModTime().Equal(modTime)
+}
+
+// Authenticate checks the password of user
+func (f *File) Authenticate(user, password string) bool {
+	f.refresh()
+
+	f.mu.RLock()
+	hash, ok := f.users[user]
+	f.mu.RUnlock()
+
+	if !ok {
+		_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return false
+	}
+
+	return Verify(hash, password)
+}
+
+// Groups returns the sorted groups of user
+func (f *File) Groups(user string) []string {
+	f.refresh()
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.groups[user]
+}
+
+// Parse reads "user:hash" lines, blank lines and # comments are skipped
+func Parse(b []byte) (map[string]string, error) {
+	users := map[string]string{}
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("line %d: expected user:hash", n)
+		}
+		if !supported(parts[1]) {
+			return nil, fmt.Errorf("line %d: unsupported hash for user %s, use bcrypt, {SHA} or $apr1$", n, parts[0])
+		}
+		users[parts[0]] = parts[1]
+	}
+
+	return users, sc.Err()
+}
+
+// ParseGroups reads "group: user1 user2" lines and returns the groups by user
+func ParseGroups(b []byte) (map[string][]string, error) {
+	groups := map[string][]string{}
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		group := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || group == "" {
+			return nil, fmt.Errorf("line %d: expected group: users", n)
+		}
+		for _, user := range strings.Fields(parts[1]) {
+			groups[user] = append(groups[user], group)
+		}
+	}
+	for _, g := range groups {
+		sort.Strings(g)
+	}
+
+	return groups, sc.Err()
+}
+
+func supported(hash string) bool {
+	return isBcrypt(hash) || strings.HasPrefix(hash, "{SHA}") || strings.HasPrefix(hash, apr1Magic)
+}
+
+func isBcrypt(hash string) bool {
+	return strings.HasPrefix(hash, "$2y$") || strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$")
+}
+
+// Verify compares password with a bcrypt, {SHA} or $apr1$ hash
+func Verify(hash, password string) bool {
+	switch {
+	case isBcrypt(hash):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password)) // nolint: gosec
+		return subtle.ConstantTimeCompare([]byte(hash[len("{SHA}"):]), []byte(base64.StdEncoding.EncodeToString(sum[:]))) == 1
+	case strings.HasPrefix(hash, apr1Magic):
+		salt := strings.SplitN(hash[len(apr1Magic):], "$", 2)[0]
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(apr1(password, salt))) == 1
+	}
+
+	return false
+}
@@ -0,0 +1,273 @@
+package keto
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"traefik-tower/pkg/acp"
+	"traefik-tower/pkg/client"
+)
+
+// pageSize is the limit of the list requests
+const pageSize = 100
+
+// Client manages the policies and roles of one Keto ACP engine flavor
+type Client struct {
+	http   *client.HTTPClient
+	url    string
+	flavor string
+}
+
+func NewClient(ketoURL, flavor string) (*Client, error) {
+	c, err := client.NewClient(ketoURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{http: c, url: strings.TrimRight(ketoURL, "/"), flavor: flavor}, nil
+}
+
+func (c *Client) path(p string) string {
+	return c.url + strings.ReplaceAll(p, "{flavor}", url.PathEscape(c.flavor))
+}
+
+func (c *Client) do(method, path string, payload, response interface{}) error {
+	var (
+		r   *http.Request
+		err error
+	)
+	if payload != nil {
+		r, err = c.http.NewRequestJSON(method, path, payload)
+	} else {
+		r, err = c.http.NewRequest(method, path, nil)
+	}
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json")
+
+	status, err := c.http.Send(r, response)
+	if err != nil {
+		return fmt.Errorf("%s %s: %w", method, path, err)
+	}
+	if status >= http.StatusMultipleChoices {
+		return fmt.Errorf("%s %s: status %d", method, path, status)
+	}
+
+	return nil
+}
+
+// Policies lists all policies
+func (c *Client) Policies() ([]acp.Policy, error) {
+	var all []acp.Policy
+	for offset := 0; ; offset += pageSize {
+		var page []acp.Policy
+		if err := c.do("GET", c.list(client.KetoPoliciesPath, offset), nil, &page); err != nil {
+			return nil, err
+		}
+		all = append(all, page...)
+		if len(page) < pageSize {
+			return all, nil
+		}
+	}
+}
+
+// Roles lists all roles
+func (c *Client) Roles() ([]acp.Role, error) {
+	var all []acp.Role
+	for offset := 0; ; offset += pageSize {
+		var page []acp.Role
+		if err := c.do("GET", c.list(client.KetoRolesPath, offset), nil, &page); err != nil {
+			return nil, err
+		}
+		all = append(all, page...)
+		if len(page) < pageSize {
+			return all, nil
+		}
+	}
+}
+
+func (c *Client) list(p string, offset int) string {
+	return c.path(p) + "?limit=" + strconv.Itoa(pageSize) + "&offset=" + strconv.Itoa(offset)
+}
+
+// PutPolicy creates or replaces a policy
+func (c *Client) PutPolicy(p *acp.Policy) error {
+	return c.do("PUT", c.path(client.KetoPoliciesPath), p, nil)
+}
+
+func (c *Client) DeletePolicy(id string) error {
+	return c.do("DELETE", c.path(client.KetoPoliciesPath)+"/"+url.PathEscape(id), nil, nil)
+}
+
+// PutRole creates or replaces a role with its members
+func (c *Client) PutRole(r *acp.Role) error {
+	return c.do("PUT", c.path(client.KetoRolesPath), r, nil)
+}
+
+func (c *Client) DeleteRole(id string) error {
+	return c.do("DELETE", c.path(client.KetoRolesPath)+"/"+url.PathEscape(id), nil, nil)
+}
+
+// Change operations
+const (
+	OpCreate = "create"
+	OpUpdate = "update"
+	OpDelete = "delete"
+	// OpExtra is an object only found in Keto, it is deleted when pruning
+	OpExtra = "extra"
+)
+
+const (
+	KindPolicy = "policy"
+	KindRole   = "role"
+)
+
+// Change is one step of a sync plan
+type Change struct {
+	Op     string
+	Kind   string
+	ID     string
+	Policy *acp.Policy
+	Role   *acp.Role
+}
+
+func (ch Change) String() string {
+	sign := map[string]string{OpCreate: "+", OpUpdate: "~", OpDelete: "-", OpExtra: "?"}[ch.Op]
+	s := fmt.Sprintf("%s %s %s", sign, ch.Kind, ch.ID)
+	if ch.Op == OpExtra {
+		s += " (only in keto, deleted with -prune)"
+	}
+	return s
+}
+
+// Plan compares the wanted document with the policies and roles in Keto. Objects only found in Keto
+// are deleted when prune is set and reported as extra otherwise. Unchanged objects are left out.
+func Plan(want *acp.Document, policies []acp.Policy, roles []acp.Role, prune bool) []Change {
+	var changes []Change
+
+	extra := OpExtra
+	if prune {
+		extra = OpDelete
+	}
+
+	have := map[string]*acp.Policy{}
+	for i := range policies {
+		have[policies[i].ID] = &policies[i]
+	}
+	seen := map[string]bool{}
+	for i := range want.Policies {
+		p := &want.Policies[i]
+		seen[p.ID] = true
+		switch h, ok := have[p.ID]; {
+		case !ok:
+			changes = append(changes, Change{Op: OpCreate, Kind: KindPolicy, ID: p.ID, Policy: p})
+		case !samePolicy(p, h):
+			changes = append(changes, Change{Op: OpUpdate, Kind: KindPolicy, ID: p.ID, Policy: p})
+		}
+	}
+	for _, p := range policies {
+		if !seen[p.ID] {
+			changes = append(changes, Change{Op: extra, Kind: KindPolicy, ID: p.ID})
+		}
+	}
+
+	haveRoles := map[string]*acp.Role{}
+	for i := range roles {
+		haveRoles[roles[i].ID] = &roles[i]
+	}
+	seen = map[string]bool{}
+	for i := range want.Roles {
+		r := &want.Roles[i]
+		seen[r.ID] = true
+		switch h, ok := haveRoles[r.ID]; {
+		case !ok:
+			changes = append(changes, Change{Op: OpCreate, Kind: KindRole, ID: r.ID, Role: r})
+		case !sameSet(r.Members, h.Members):
+			changes = append(changes, Change{Op: OpUpdate, Kind: KindRole, ID: r.ID, Role: r})
+		}
+	}
+	for _, r := range roles {
+		if !seen[r.ID] {
+			changes = append(changes, Change{Op: extra, Kind: KindRole, ID: r.ID})
+		}
+	}
+
+	return changes
+}
+
+// Apply runs the changes in order, roles are written before policies so new policies never name
+// a missing role. It stops at the first error.
+func (c *Client) Apply(changes []Change) error {
+	ordered := make([]Change, len(changes))
+	copy(ordered, changes)
+	sort.SliceStable(ordered, func(i, j int) bool { return ordered[i].Kind == KindRole && ordered[j].Kind != KindRole })
+
+	for _, ch := range ordered {
+		var err error
+		switch {
+		case ch.Op == OpExtra:
+			continue
+		case ch.Kind == KindPolicy && ch.Op == OpDelete:
+			err = c.DeletePolicy(ch.ID)
+		case ch.Kind == KindPolicy:
+			err = c.PutPolicy(ch.Policy)
+		case ch.Kind == KindRole && ch.Op == OpDelete:
+			err = c.DeleteRole(ch.ID)
+		case ch.Kind == KindRole:
+			err = c.PutRole(ch.Role)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", ch, err)
+		}
+	}
+
+	return nil
+}
+
+// samePolicy compares policies as Keto stores them, empty and missing lists and conditions are equal
+func samePolicy(a, b *acp.Policy) bool {
+	return a.Description == b.Description && a.Effect == b.Effect &&
+		sameList(a.Subjects, b.Subjects) && sameList(a.Resources, b.Resources) && sameList(a.Actions, b.Actions) &&
+		sameConditions(a.Conditions, b.Conditions)
+}
+
+func sameList(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func sameSet(a, b []string) bool {
+	as := append([]string(nil), a...)
+	bs := append([]string(nil), b...)
+	sort.Strings(as)
+	sort.Strings(bs)
+	return sameList(as, bs)
+}
+
+// sameConditions compares the JSON forms, YAML and JSON decode numbers differently
+func sameConditions(a, b map[string]interface{}) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	var ja, jb interface{}
+	ba, errA := json.Marshal(a)
+	bb, errB := json.Marshal(b)
+	if errA != nil || errB != nil || json.Unmarshal(ba, &ja) != nil || json.Unmarshal(bb, &jb) != nil {
+		return false
+	}
+	return reflect.DeepEqual(ja, jb)
+}
@@ -0,0 +1,286 @@
+package ldapauth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+var (
+	ErrInvalidCredentials = errors.New("invalid ldap credentials")
+	ErrUserNotFound       = errors.New("ldap user not found")
+	ErrAmbiguousUser      = errors.New("ldap user filter matches several entries")
+)
+
+// Options of the directory, %s in the filters is replaced by the escaped user name or, in GroupFilter, the user DN
+type Options struct {
+	URL          string
+	StartTLS     bool
+	CAFile       string
+	BindDN       string
+	BindPassword string
+	BaseDN       string
+	UserFilter   string
+	// GroupAttribute lists the group DNs on the user entry, e.g. memberOf
+	GroupAttribute string
+	// GroupFilter searches groups below GroupBaseDN instead, e.g. (member=%s)
+	GroupBaseDN string
+	GroupFilter string
+	// GroupNameAttribute names a group, e.g. cn
+	GroupNameAttribute string
+	PoolSize           int
+	Timeout            time.Duration
+}
+
+// User is an authenticated directory entry
+type User struct {
+	DN     string
+	Groups []string
+}
+
+// Authenticator binds with a service account, searches the user and binds as the user. Connections are pooled.
+type Authenticator struct {
+	opts Options
+	tls  *tls.Config
+
+	mu     sync.Mutex
+	pool   chan *ldap.Conn
+	closed bool
+}
+
+// New checks the options, connections are opened on first use
+func New(o Options) (*Authenticator, error) {
+	u, err := url.Parse(o.URL)
+	if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Hostname() == "" {
+		return nil, fmt.Errorf("ldap url %q must be ldap:// or ldaps://", o.URL)
+	}
+
+	a := &Authenticator{
+		opts: o,
+		tls:  &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12},
+		pool: make(chan *ldap.Conn, o.PoolSize),
+	}
+	if o.CAFile != "" {
+		b, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		a.tls.RootCAs = x509.NewCertPool()
+		if !a.tls.RootCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("ldap ca file %s: no certificates", o.CAFile)
+		}
+	}
+
+	return a, nil
+}
+
+// Authenticate verifies the password of user and returns its entry and groups
+func (a *Authenticator) Authenticate(user, password string) (*User, error) {
+	// an empty password would be an unauthenticated bind, which servers accept
+	if user == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	u, err := a.authenticate(user, password)
+	if err != nil && ldap.IsErrorWithCode(err, ldap.ErrorNetwork) {
+		// pooled connections may have been closed by the server, retry once on a new one
+		u, err = a.authenticate(user, password)
+	}
+
+	return u, err
+}
+
+func (a *Authenticator) authenticate(user, password string) (*User, error) {
+	conn, err := a.get()
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := a.lookup(conn, user)
+	if err != nil {
+		a.release(conn, err)
+		return nil, err
+	}
+
+	if err := conn.Bind(u.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			err = ErrInvalidCredentials
+		}
+		a.release(conn, err)
+		return nil, err
+	}
+
+	if a.opts.GroupFilter != "" {
+		if u.Groups, err = a.searchGroups(conn, u.DN); err != nil {
+			a.release(conn, err)
+			return nil, err
+		}
+	}
+	a.release(conn, nil)
+
+	return u, nil
+}
+
+// lookup binds as the service account, or anonymously without one, and finds the user entry
+func (a *Authenticator) lookup(conn *ldap.Conn, user string) (*User, error) {
+	if err := a.serviceBind(conn); err != nil {
+		return nil, err
+	}
+
+	attrs := []string{"dn"}
+	if a.opts.GroupAttribute != "" {
+		attrs = append(attrs, a.opts.GroupAttribute)
+	}
+	res, err := conn.Search(ldap.NewSearchRequest(
+		a.opts.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, a.timeLimit(), false,
+		strings.ReplaceAll(a.opts.UserFilter, "%s", ldap.EscapeFilter(user)), attrs, nil,
+	))
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, err
+	}
+
+	switch {
+	case res == nil || len(res.Entries) == 0:
+		return nil, ErrUserNotFound
+	case len(res.Entries) > 1:
+		return nil, ErrAmbiguousUser
+	}
+
+	entry := res.Entries[0]
+	u := &User{DN: entry.DN}
+	if a.opts.GroupAttribute != "" {
+		for _, dn := range entry.GetAttributeValues(a.opts.GroupAttribute) {
+			u.Groups = append(u.Groups, groupName(dn))
+		}
+		sort.Strings(u.Groups)
+	}
+
+	return u, nil
+}
+
+// searchGroups finds the groups listing the user, the connection is bound as the user at this point
+func (a *Authenticator) searchGroups(conn *ldap.Conn, dn string) ([]string, error) {
+	if err := a.serviceBind(conn); err != nil {
+		return nil, err
+	}
+
+	res, err := conn.Search(ldap.NewSearchRequest(
+		a.opts.GroupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, a.timeLimit(), false,
+		strings.ReplaceAll(a.opts.GroupFilter, "%s", ldap.EscapeFilter(dn)), []string{a.opts.GroupNameAttribute}, nil,
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make([]string, 0, len(res.Entries))
+	for _, e := range res.Entries {
+		if name := e.GetAttributeValue(a.opts.GroupNameAttribute); name != "" {
+			groups = append(groups, name)
+		}
+	}
+	sort.Strings(groups)
+
+	return groups, nil
+}
+
+func (a *Authenticator) serviceBind(conn *ldap.Conn) error {
+	if a.opts.BindDN == "" {
+		return conn.UnauthenticatedBind("")
+	}
+	return conn.Bind(a.opts.BindDN, a.opts.BindPassword)
+}
+
+func (a *Authenticator) timeLimit() int {
+	return int(a.opts.Timeout / time.Second)
+}
+
+// groupName is the value of the first RDN of a group DN, e.g. admins of cn=admins,ou=groups,dc=example,dc=org
+func groupName(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil || len(parsed.RDNs) == 0 || len(parsed.RDNs[0].Attributes) == 0 {
+		return dn
+	}
+	return parsed.RDNs[0].Attributes[0].Value
+}
+
+// get takes a pooled connection or dials a new one
+func (a *Authenticator) get() (*ldap.Conn, error) {
+	for {
+		select {
+		case conn := <-a.pool:
+			if !conn.IsClosing() {
+				return conn, nil
+			}
+			conn.Close()
+		default:
+			return a.dial()
+		}
+	}
+}
+
+// release returns the connection to the pool unless err broke it
+func (a *Authenticator) release(conn *ldap.Conn, err error) {
+	if err != nil && (ldap.IsErrorWithCode(err, ldap.ErrorNetwork) || conn.IsClosing()) {
+		conn.Close()
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.closed {
+		conn.Close()
+		return
+	}
+	select {
+	case a.pool <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// Close closes the pooled connections, connections in use are closed once they are released
+func (a *Authenticator) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.closed = true
+	for {
+		select {
+		case conn := <-a.pool:
+			conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+func (a *Authenticator) dial() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(a.opts.URL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: a.opts.Timeout}),
+		ldap.DialWithTLSConfig(a.tls),
+	)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(a.opts.Timeout)
+
+	if a.opts.StartTLS {
+		if err := conn.StartTLS(a.tls); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
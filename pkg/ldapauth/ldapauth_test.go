@@ -0,0 +1,304 @@
+package ldapauth
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// entry is a directory entry of the test server
+type entry struct {
+	password string
+	attrs    map[string][]string
+}
+
+var directory = map[string]entry{
+	"cn=svc,dc=example,dc=org": {password: "svc-secret"},
+	"uid=alice,ou=people,dc=example,dc=org": {password: "alice-secret", attrs: map[string][]string{
+		"uid":      {"alice"},
+		"memberOf": {"cn=admins,ou=groups,dc=example,dc=org", "cn=dev,ou=groups,dc=example,dc=org"},
+	}},
+	"uid=bob,ou=people,dc=example,dc=org": {password: "bob-secret", attrs: map[string][]string{
+		"uid": {"bob"},
+	}},
+	"cn=ops,ou=groups,dc=example,dc=org": {attrs: map[string][]string{
+		"cn":     {"ops"},
+		"member": {"uid=bob,ou=people,dc=example,dc=org"},
+	}},
+}
+
+// server is an in-process LDAP stand-in answering simple binds and equality filter searches
+type server struct {
+	ln    net.Listener
+	mu    sync.Mutex
+	conns map[net.Conn]bool
+}
+
+func newServer(t *testing.T) *server {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server{ln: ln, conns: map[net.Conn]bool{}}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns[conn] = true
+			s.mu.Unlock()
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *server) url() string {
+	return "ldap://" + s.ln.Addr().String()
+}
+
+// open counts the client connections that are still open
+func (s *server) open() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+func (s *server) serve(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+
+	for {
+		p, err := ber.ReadPacket(conn)
+		if err != nil || len(p.Children) < 2 {
+			return
+		}
+		id, _ := p.Children[0].Value.(int64)
+		op := p.Children[1]
+
+		var out []*ber.Packet
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			out = append(out, result(id, ldap.ApplicationBindResponse, bind(op)))
+		case ldap.ApplicationSearchRequest:
+			entries, code := search(op)
+			for _, e := range entries {
+				out = append(out, e.packet(id))
+			}
+			out = append(out, result(id, ldap.ApplicationSearchResultDone, code))
+		default:
+			// unbind and everything else ends the connection
+			return
+		}
+
+		for _, r := range out {
+			if _, err := conn.Write(r.Bytes()); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func bind(op *ber.Packet) int64 {
+	dn, password := op.Children[1].Data.String(), op.Children[2].Data.String()
+	if dn == "" && password == "" {
+		return ldap.LDAPResultSuccess
+	}
+	if e, ok := directory[dn]; ok && e.password != "" && e.password == password {
+		return ldap.LDAPResultSuccess
+	}
+	return ldap.LDAPResultInvalidCredentials
+}
+
+type found struct {
+	dn    string
+	attrs map[string][]string
+}
+
+// search supports filters of one equality assertion, e.g. (uid=alice)
+func search(op *ber.Packet) ([]found, int64) {
+	base := strings.ToLower(op.Children[0].Data.String())
+	filter, err := ldap.DecompileFilter(op.Children[6])
+	if err != nil {
+		return nil, ldap.LDAPResultProtocolError
+	}
+	kv := strings.SplitN(strings.Trim(filter, "()"), "=", 2)
+	if len(kv) != 2 {
+		return nil, ldap.LDAPResultUnwillingToPerform
+	}
+
+	var entries []found
+	for dn, e := range directory {
+		if !strings.HasSuffix(strings.ToLower(dn), base) {
+			continue
+		}
+		for _, v := range e.attrs[kv[0]] {
+			if strings.EqualFold(v, kv[1]) {
+				entries = append(entries, found{dn: dn, attrs: e.attrs})
+				break
+			}
+		}
+	}
+
+	return entries, ldap.LDAPResultSuccess
+}
+
+func envelope(id int64, op *ber.Packet) *ber.Packet {
+	p := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "MessageID"))
+	p.AppendChild(op)
+	return p
+}
+
+func result(id int64, tag ber.Tag, code int64) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "resultCode"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "diagnosticMessage"))
+	return envelope(id, op)
+}
+
+func (f found) packet(id int64) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Entry")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, f.dn, "objectName"))
+	attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attributes")
+	for name, values := range f.attrs {
+		a := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attribute")
+		a.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "type"))
+		vals := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "vals")
+		for _, v := range values {
+			vals.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "value"))
+		}
+		a.AppendChild(vals)
+		attrs.AppendChild(a)
+	}
+	op.AppendChild(attrs)
+	return envelope(id, op)
+}
+
+func options(url string) Options {
+	return Options{
+		URL:            url,
+		BindDN:         "cn=svc,dc=example,dc=org",
+		BindPassword:   "svc-secret",
+		BaseDN:         "ou=people,dc=example,dc=org",
+		UserFilter:     "(uid=%s)",
+		GroupAttribute: "memberOf",
+		PoolSize:       2,
+		Timeout:        time.Second,
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	s := newServer(t)
+	a, err := New(options(s.url()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	tests := []struct {
+		name     string
+		user     string
+		password string
+		want     *User
+		err      error
+	}{
+		{
+			name:     "good bind",
+			user:     "alice",
+			password: "alice-secret",
+			want:     &User{DN: "uid=alice,ou=people,dc=example,dc=org", Groups: []string{"admins", "dev"}},
+		},
+		{name: "wrong password", user: "alice", password: "bob-secret", err: ErrInvalidCredentials},
+		{name: "missing user", user: "carol", password: "carol-secret", err: ErrUserNotFound},
+		{name: "empty password", user: "alice", err: ErrInvalidCredentials},
+		{name: "filter injection", user: "*", password: "alice-secret", err: ErrUserNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := a.Authenticate(tt.user, tt.password)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if !reflect.DeepEqual(u, tt.want) {
+				t.Errorf("user = %+v, want %+v", u, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthenticateGroupFilter(t *testing.T) {
+	s := newServer(t)
+	o := options(s.url())
+	o.GroupAttribute = ""
+	o.GroupBaseDN = "ou=groups,dc=example,dc=org"
+	o.GroupFilter = "(member=%s)"
+	o.GroupNameAttribute = "cn"
+	a, err := New(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	u, err := a.Authenticate("bob", "bob-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"ops"}; !reflect.DeepEqual(u.Groups, want) {
+		t.Errorf("groups = %v, want %v", u.Groups, want)
+	}
+
+	u, err = a.Authenticate("alice", "alice-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(u.Groups) != 0 {
+		t.Errorf("groups = %v, want none", u.Groups)
+	}
+}
+
+func TestClose(t *testing.T) {
+	s := newServer(t)
+	a, err := New(options(s.url()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := a.Authenticate("alice", "alice-secret"); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.open(); n != 1 {
+		t.Fatalf("open connections = %d, want 1 pooled", n)
+	}
+
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for s.open() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := s.open(); n != 0 {
+		t.Errorf("open connections after Close = %d, want 0", n)
+	}
+}
@@ -0,0 +1,330 @@
+package login
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"traefik-tower/pkg/client"
+	"traefik-tower/pkg/decision"
+	"traefik-tower/pkg/forward"
+)
+
+// stateTTL bounds the time between the redirect to the authorization server and the callback
+const stateTTL = 10 * time.Minute
+
+// Options configure the authorization code flow, see config.Config Login* fields
+type Options struct {
+	AuthorizeURL string
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is the public URL of the /callback endpoint registered with the client
+	RedirectURL string
+	Scopes      []string
+
+	CookieName   string
+	CookieDomain string
+	CookieSecure bool
+	CookieSecret string
+	// SessionTTL caps the session lifetime, the access token expiry ends it earlier
+	SessionTTL time.Duration
+}
+
+// Login authenticates browsers with an authorization code + PKCE flow. The access token is kept in an
+// encrypted session cookie and passed to the auth handlers as a bearer token, so every backend that
+// validates access tokens works unchanged.
+type Login struct {
+	opts   Options
+	sealer *Sealer
+	client *client.HTTPClient
+}
+
+type session struct {
+	AccessToken string    `json:"at"`
+	Expiry      time.Time `json:"exp"`
+}
+
+type state struct {
+	Nonce    string    `json:"n"`
+	Verifier string    `json:"v"`
+	Redirect string    `json:"r"`
+	Expiry   time.Time `json:"exp"`
+}
+
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	ExpiresIn        int    `json:"expires_in"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+func New(opts Options) (*Login, error) {
+	sealer, err := NewSealer(opts.CookieSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := client.NewClient(opts.TokenURL)
+	if err != nil {
+		return nil, fmt.Errorf("login token url: %w", err)
+	}
+
+	return &Login{opts: opts, sealer: sealer, client: c}, nil
+}
+
+func (l *Login) stateCookieName() string {
+	return l.opts.CookieName + "_state"
+}
+
+// Handler authenticates requests without a bearer token from the session cookie and
+// redirects browsers without a valid session to the authorization server instead of answering 401.
+// Authorization denials are answered with 401, a new login would be denied again.
+func (l *Login) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "" {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		if s := l.session(req); s != nil {
+			req.Header.Set("Authorization", "Bearer "+s.AccessToken)
+		}
+
+		if isBrowser(req) {
+			capture := &decision.Capture{}
+			req = req.WithContext(decision.NewCaptureContext(req.Context(), capture))
+			w = &redirectWriter{ResponseWriter: w, login: l, req: req, capture: capture}
+		}
+
+		next.ServeHTTP(w, req)
+	})
+}
+
+func (l *Login) session(req *http.Request) *session {
+	c, err := req.Cookie(l.opts.CookieName)
+	if err != nil {
+		return nil
+	}
+
+	s := &session{}
+	if err := l.sealer.Open(c.Value, s); err != nil || time.Now().After(s.Expiry) || s.AccessToken == "" {
+		return nil
+	}
+
+	return s
+}
+
+// redirect starts the flow for the original request, false when the original URL is unknown
+func (l *Login) redirect(w http.ResponseWriter, req *http.Request) bool {
+	fr := forward.FromContext(req.Context())
+	if fr.Host == "" {
+		return false
+	}
+
+	proto := fr.Proto
+	if proto == "" {
+		proto = "https"
+	}
+
+	verifier, err := randomString(32)
+	if err != nil {
+		log.Error().Err(err).Msg("login verifier")
+		return false
+	}
+	nonce, err := randomString(16)
+	if err != nil {
+		log.Error().Err(err).Msg("login nonce")
+		return false
+	}
+
+	sealed, err := l.sealer.Seal(&state{
+		Nonce:    nonce,
+		Verifier: verifier,
+		Redirect: fmt.Sprintf("%s://%s%s", proto, fr.Host, fr.URI),
+		Expiry:   time.Now().Add(stateTTL),
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("login state")
+		return false
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", l.opts.ClientID)
+	q.Set("redirect_uri", l.opts.RedirectURL)
+	q.Set("scope", strings.Join(l.opts.Scopes, " "))
+	q.Set("state", sealed)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+
+	// the nonce binds the state to this browser
+	l.setCookie(w, l.stateCookieName(), nonce, stateTTL)
+	// a stale session is replaced by the new one
+	if _, err := req.Cookie(l.opts.CookieName); err == nil {
+		l.setCookie(w, l.opts.CookieName, "", -1)
+	}
+
+	w.Header().Del("Content-Type")
+	w.Header().Set("Location", l.opts.AuthorizeURL+"?"+q.Encode())
+	w.WriteHeader(http.StatusFound)
+
+	return true
+}
+
+// Callback exchanges the authorization code and sets the session cookie
+func (l *Login) Callback(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	if e := q.Get("error"); e != "" {
+		http.Error(w, "login failed: "+e, http.StatusUnauthorized)
+		return
+	}
+	if q.Get("code") == "" {
+		http.Error(w, "missing authorization code", http.StatusBadRequest)
+		return
+	}
+
+	st := &state{}
+	if err := l.sealer.Open(q.Get("state"), st); err != nil || time.Now().After(st.Expiry) {
+		http.Error(w, "invalid or expired login state", http.StatusBadRequest)
+		return
+	}
+
+	nonce, err := req.Cookie(l.stateCookieName())
+	if err != nil || nonce.Value != st.Nonce {
+		http.Error(w, "login state does not belong to this browser", http.StatusBadRequest)
+		return
+	}
+
+	token, err := l.exchange(q.Get("code"), st.Verifier)
+	if err != nil {
+		log.Error().Err(err).Msg("login code exchange")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	ttl := l.opts.SessionTTL
+	if expiresIn := time.Duration(token.ExpiresIn) * time.Second; expiresIn > 0 && expiresIn < ttl {
+		ttl = expiresIn
+	}
+
+	sealed, err := l.sealer.Seal(&session{AccessToken: token.AccessToken, Expiry: time.Now().Add(ttl)})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	l.setCookie(w, l.opts.CookieName, sealed, ttl)
+	l.setCookie(w, l.stateCookieName(), "", -1)
+	http.Redirect(w, req, st.Redirect, http.StatusFound)
+}
+
+func (l *Login) exchange(code, verifier string) (*tokenResponse, error) {
+	data := url.Values{}
+	data.Set("grant_type", "authorization_code")
+	data.Set("code", code)
+	data.Set("redirect_uri", l.opts.RedirectURL)
+	data.Set("client_id", l.opts.ClientID)
+	data.Set("code_verifier", verifier)
+
+	r, err := l.client.NewRequest("POST", l.opts.TokenURL, strings.NewReader(data.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Content-Length", strconv.Itoa(len(data.Encode())))
+	if l.opts.ClientSecret != "" {
+		r.SetBasicAuth(url.QueryEscape(l.opts.ClientID), url.QueryEscape(l.opts.ClientSecret))
+	}
+
+	token := &tokenResponse{}
+	status, err := l.client.Send(r, token)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK || token.AccessToken == "" {
+		return nil, fmt.Errorf("token endpoint returned %d: %s %s", status, token.Error, token.ErrorDescription)
+	}
+
+	return token, nil
+}
+
+func (l *Login) setCookie(w http.ResponseWriter, name, value string, ttl time.Duration) {
+	c := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Domain:   l.opts.CookieDomain,
+		Secure:   l.opts.CookieSecure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if ttl < 0 {
+		c.MaxAge = -1
+	} else {
+		c.MaxAge = int(ttl.Seconds())
+	}
+
+	http.SetCookie(w, c)
+}
+
+// isBrowser reports whether the original request expects an HTML page
+func isBrowser(req *http.Request) bool {
+	return strings.Contains(req.Header.Get("Accept"), "text/html")
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// redirectWriter replaces a 401 response to a request without a valid credential by the redirect to
+// the authorization server
+type redirectWriter struct {
+	http.ResponseWriter
+	login      *Login
+	req        *http.Request
+	capture    *decision.Capture
+	redirected bool
+}
+
+func (w *redirectWriter) WriteHeader(status int) {
+	if status == http.StatusUnauthorized && w.unauthenticated() && w.login.redirect(w.ResponseWriter, w.req) {
+		w.redirected = true
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// unauthenticated reports whether the request was denied for a missing or rejected credential
+func (w *redirectWriter) unauthenticated() bool {
+	rec := w.capture.Record
+	if rec == nil {
+		return true
+	}
+
+	switch rec.Reason {
+	case decision.ReasonMissingToken, decision.ReasonInactiveToken:
+		return true
+	}
+	return false
+}
+
+func (w *redirectWriter) Write(b []byte) (int, error) {
+	if w.redirected {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
@@ -0,0 +1,120 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"traefik-tower/pkg/decision"
+)
+
+const namespace = "traefik_tower"
+
+// Labels are limited to values from bounded sets: configured tenants and route rule names, auth types,
+// stages, reasons and status codes
+var (
+	Decisions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "decisions_total",
+		Help:      "Auth decisions by tenant, auth type, route rule, outcome and reason.",
+	}, []string{"tenant", "auth_type", "route", "outcome", "reason"})
+
+	DecisionDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "decision_duration_seconds",
+		Help:      "Time taken to reach an auth decision.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"tenant", "auth_type", "route", "outcome"})
+
+	StageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "stage_duration_seconds",
+		Help:      "Time spent in each auth pipeline stage.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"tenant", "auth_type", "stage"})
+
+	UpstreamResponses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_responses_total",
+		Help:      "Responses from upstream identity and policy services by status code.",
+	}, []string{"upstream", "code"})
+
+	CacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_requests_total",
+		Help:      "Cache lookups by cache name and result (hit or miss).",
+	}, []string{"cache", "result"})
+
+	CacheEntries = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cache_entries",
+		Help:      "Number of entries currently held in a cache.",
+	}, []string{"cache"})
+
+	ConfigReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "config_reloads_total",
+		Help:      "Config reloads by result (success or error).",
+	}, []string{"result"})
+
+	InFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "in_flight_requests",
+		Help:      "Auth requests currently being processed.",
+	}, []string{"auth_type"})
+
+	ClientBlocks = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "client_blocks_total",
+		Help:      "Client IPs blocked for sending invalid credentials.",
+	})
+)
+
+// BlockedClients exports the number of currently blocked client IPs, it is registered once
+func BlockedClients(count func() int) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "blocked_clients",
+		Help:      "Client IPs currently blocked for sending invalid credentials.",
+	}, func() float64 { return float64(count()) })
+}
+
+// Observe exports a finished decision record
+func Observe(rec *decision.Record) {
+	if rec == nil {
+		return
+	}
+
+	Decisions.WithLabelValues(rec.Tenant, rec.AuthType, rec.Route, string(rec.Outcome), rec.Reason).Inc()
+	DecisionDuration.WithLabelValues(rec.Tenant, rec.AuthType, rec.Route, string(rec.Outcome)).Observe(rec.Took().Seconds())
+
+	for _, s := range rec.Stages {
+		StageDuration.WithLabelValues(rec.Tenant, rec.AuthType, s.Name).Observe(s.Duration.Seconds())
+	}
+
+	for _, u := range rec.Upstreams {
+		UpstreamResponses.WithLabelValues(u.Name, statusLabel(u.Status)).Inc()
+	}
+}
+
+// CacheLookup counts a cache hit or miss
+func CacheLookup(cache string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	CacheRequests.WithLabelValues(cache, result).Inc()
+}
+
+// statusLabel keeps unexpected values out of the label set
+func statusLabel(status int) string {
+	if status == 0 {
+		return "error"
+	}
+	if http.StatusText(status) == "" {
+		return "other"
+	}
+	return strconv.Itoa(status)
+}
@@ -6,6 +6,8 @@ import (
 	"strings"
 
 	"github.com/rs/zerolog/log"
+
+	"traefik-tower/pkg/redact"
 )
 
 // Logs incoming requests, including response status.
@@ -21,7 +23,7 @@ func Logger(h http.Handler) http.Handler {
 		log.Debug().
 			Timestamp().
 			Str("addr", addr).
-			Str("url", fmt.Sprintf("%s %s %s", r.Method, r.URL, r.Proto)).
+			Str("url", fmt.Sprintf("%s %s %s", r.Method, redact.URL(r.URL), r.Proto)).
 			Int("status", o.status).
 			Int64("res_len", o.written).
 			Str("referer", r.Referer()).
@@ -0,0 +1,243 @@
+package mtls
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Consumer id sources
+const (
+	IDCommonName = "cn"
+	IDDNS        = "dns"
+	IDEmail      = "email"
+	IDURI        = "uri"
+	IDSPIFFE     = "spiffe"
+)
+
+var IDSources = []string{IDCommonName, IDDNS, IDEmail, IDURI, IDSPIFFE}
+
+var (
+	ErrMalformed = errors.New("malformed client certificate")
+	ErrRevoked   = errors.New("client certificate revoked")
+	ErrNoID      = errors.New("client certificate has no consumer id")
+)
+
+// Verifier checks client certificates against CA bundles and CRLs
+type Verifier struct {
+	roots *x509.CertPool
+	// crls by the raw subject of the CA that signed them
+	crls map[string][]*x509.RevocationList
+}
+
+// NewVerifier loads PEM CA bundles and PEM or DER CRLs, every CRL must be signed by one of the CAs
+func NewVerifier(caFiles, crlFiles []string) (*Verifier, error) {
+	v := &Verifier{
+		roots: x509.NewCertPool(),
+		crls:  map[string][]*x509.RevocationList{},
+	}
+
+	var cas []*x509.Certificate
+	for _, f := range caFiles {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		certs, err := parsePEM(b)
+		if err != nil || len(certs) == 0 {
+			return nil, fmt.Errorf("ca file %s: no certificates", f)
+		}
+		for _, c := range certs {
+			v.roots.AddCert(c)
+		}
+		cas = append(cas, certs...)
+	}
+
+	for _, f := range crlFiles {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		if p, _ := pem.Decode(b); p != nil {
+			b = p.Bytes
+		}
+		crl, err := x509.ParseRevocationList(b)
+		if err != nil {
+			return nil, fmt.Errorf("crl file %s: %w", f, err)
+		}
+
+		signed := false
+		for _, ca := range cas {
+			if crl.CheckSignatureFrom(ca) == nil {
+				signed = true
+				break
+			}
+		}
+		if !signed {
+			return nil, fmt.Errorf("crl file %s: not signed by a configured ca", f)
+		}
+		if !crl.NextUpdate.IsZero() && time.Now().After(crl.NextUpdate) {
+			log.Warn().Str("file", f).Time("next_update", crl.NextUpdate).Msg("crl is past its next update")
+		}
+
+		v.crls[string(crl.RawIssuer)] = append(v.crls[string(crl.RawIssuer)], crl)
+	}
+
+	return v, nil
+}
+
+// Verify checks the leaf certificate with the rest of certs as intermediates and returns the leaf
+func (v *Verifier) Verify(certs []*x509.Certificate) (*x509.Certificate, error) {
+	if len(certs) == 0 {
+		return nil, ErrMalformed
+	}
+
+	leaf := certs[0]
+	intermediates := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		intermediates.AddCert(c)
+	}
+
+	chains, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         v.roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// every certificate but the root is checked against the CRLs of its issuer
+	for _, chain := range chains {
+		for _, c := range chain[:len(chain)-1] {
+			if v.revoked(c) {
+				return nil, ErrRevoked
+			}
+		}
+	}
+
+	return leaf, nil
+}
+
+func (v *Verifier) revoked(c *x509.Certificate) bool {
+	for _, crl := range v.crls[string(c.RawIssuer)] {
+		for _, rc := range crl.RevokedCertificateEntries {
+			if rc.SerialNumber.Cmp(c.SerialNumber) == 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsExpired reports whether a Verify error is caused by an expired or not yet valid certificate
+func IsExpired(err error) bool {
+	var ie x509.CertificateInvalidError
+	return errors.As(err, &ie) && ie.Reason == x509.Expired
+}
+
+// ParseHeader reads the forwarded certificate chain, leaf first. It accepts URL-encoded PEM (nginx
+// $ssl_client_escaped_cert, Envoy) and Traefik's comma separated base64 DER without PEM delimiters.
+func ParseHeader(value string) ([]*x509.Certificate, error) {
+	value = strings.TrimSpace(value)
+	if strings.Contains(value, "%") {
+		unescaped, err := url.PathUnescape(value)
+		if err != nil {
+			return nil, ErrMalformed
+		}
+		value = unescaped
+	}
+
+	if strings.Contains(value, "-----BEGIN") {
+		certs, err := parsePEM([]byte(value))
+		if err != nil || len(certs) == 0 {
+			return nil, ErrMalformed
+		}
+		return certs, nil
+	}
+
+	var certs []*x509.Certificate
+	for _, part := range strings.Split(value, ",") {
+		der, err := base64.StdEncoding.DecodeString(strings.TrimSpace(part))
+		if err != nil {
+			return nil, ErrMalformed
+		}
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, ErrMalformed
+		}
+		certs = append(certs, c)
+	}
+
+	return certs, nil
+}
+
+func parsePEM(b []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var p *pem.Block
+		p, b = pem.Decode(b)
+		if p == nil {
+			return certs, nil
+		}
+		if p.Type != "CERTIFICATE" {
+			continue
+		}
+		c, err := x509.ParseCertificate(p.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, c)
+	}
+}
+
+// ConsumerID derives the consumer id from the certificate, SPIFFE ids are limited to trustDomains when set
+func ConsumerID(c *x509.Certificate, source string, trustDomains []string) (string, error) {
+	switch source {
+	case IDCommonName:
+		if c.Subject.CommonName != "" {
+			return c.Subject.CommonName, nil
+		}
+	case IDDNS:
+		if len(c.DNSNames) > 0 {
+			return c.DNSNames[0], nil
+		}
+	case IDEmail:
+		if len(c.EmailAddresses) > 0 {
+			return c.EmailAddresses[0], nil
+		}
+	case IDURI:
+		if len(c.URIs) > 0 {
+			return c.URIs[0].String(), nil
+		}
+	case IDSPIFFE:
+		for _, u := range c.URIs {
+			if u.Scheme != "spiffe" {
+				continue
+			}
+			if len(trustDomains) > 0 && !contains(trustDomains, u.Host) {
+				continue
+			}
+			return u.String(), nil
+		}
+	}
+
+	return "", ErrNoID
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,120 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// maxEntries bounds the memory used by the buckets, full buckets are dropped first
+const maxEntries = 100000
+
+// Limit allows Requests per Per on average and bursts of up to Burst requests
+type Limit struct {
+	Requests int
+	Per      time.Duration
+	// Burst is the bucket size, Requests when 0
+	Burst int
+}
+
+func (l Limit) burst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return float64(l.Requests)
+}
+
+// rate is the refill rate in tokens per second
+func (l Limit) rate() float64 {
+	return float64(l.Requests) / l.Per.Seconds()
+}
+
+// Result is the state of a bucket after a request
+type Result struct {
+	Allowed bool
+	// Limit is the bucket size
+	Limit     int
+	Remaining int
+	// Reset is the time until the bucket is full again
+	Reset time.Duration
+	// RetryAfter is the time until the next request is allowed, 0 when allowed
+	RetryAfter time.Duration
+}
+
+// Store keeps the token buckets. The in-memory store limits each replica on its own,
+// deployments with several replicas can plug in a shared store.
+type Store interface {
+	// Take takes a token from the bucket of key
+	Take(key string, limit Limit) (Result, error)
+}
+
+// Memory is a Store of token buckets in process memory
+type Memory struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	// limit is the limit of the last request, it tells purge when the bucket is full again
+	limit Limit
+}
+
+func NewMemory() *Memory {
+	return &Memory{buckets: map[string]*bucket{}}
+}
+
+// Take never fails
+func (m *Memory) Take(key string, limit Limit) (Result, error) {
+	size, rate := limit.burst(), limit.rate()
+	res := Result{Limit: int(size)}
+	if size <= 0 || rate <= 0 {
+		return res, nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	b, ok := m.buckets[key]
+	if !ok {
+		if len(m.buckets) >= maxEntries {
+			m.purge(now)
+		}
+		b = &bucket{tokens: size, last: now}
+		m.buckets[key] = b
+	}
+	b.tokens = math.Min(size, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last, b.limit = now, limit
+
+	if b.tokens >= 1 {
+		b.tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = seconds((1 - b.tokens) / rate)
+	}
+	res.Remaining = int(b.tokens)
+	res.Reset = seconds((size - b.tokens) / rate)
+
+	return res, nil
+}
+
+// purge drops buckets that are full again, then arbitrary ones
+func (m *Memory) purge(now time.Time) {
+	for k, b := range m.buckets {
+		if now.Sub(b.last) >= seconds((b.limit.burst()-b.tokens)/b.limit.rate()) {
+			delete(m.buckets, k)
+		}
+	}
+	for k := range m.buckets {
+		if len(m.buckets) < maxEntries {
+			break
+		}
+		delete(m.buckets, k)
+	}
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
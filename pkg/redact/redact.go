@@ -0,0 +1,319 @@
+package redact
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+const (
+	fingerprintLen = 8
+	redacted       = "[REDACTED]"
+)
+
+// cookie headers keep the cookie names and mask the values
+var cookieHeaders = map[string]bool{
+	"Cookie":     true,
+	"Set-Cookie": true,
+}
+
+var (
+	mu sync.RWMutex
+	// headers are masked in full, except for the auth scheme
+	headers = map[string]bool{
+		"Authorization":        true,
+		"Proxy-Authorization":  true,
+		"X-Api-Key":            true,
+		"X-Session-Token":      true,
+		"X-Amz-Security-Token": true,
+	}
+	// claims are JSON keys, form fields and query params masked wherever they appear
+	claims = map[string]bool{
+		"token":         true,
+		"access_token":  true,
+		"refresh_token": true,
+		"id_token":      true,
+		"client_secret": true,
+		"password":      true,
+		"secret":        true,
+		"code_verifier": true,
+		"code":          true,
+	}
+)
+
+// AddClaims extends the set of masked claim names, matched case-insensitively
+func AddClaims(names ...string) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	for _, n := range names {
+		if n = strings.TrimSpace(n); n != "" {
+			claims[strings.ToLower(n)] = true
+		}
+	}
+}
+
+// AddHeaders extends the set of masked headers, e.g. a custom api key header
+func AddHeaders(names ...string) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	for _, n := range names {
+		if n = strings.TrimSpace(n); n != "" {
+			headers[http.CanonicalHeaderKey(n)] = true
+		}
+	}
+}
+
+func isHeader(name string) bool {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	return headers[name]
+}
+
+func isClaim(name string) bool {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	return claims[strings.ToLower(name)]
+}
+
+// Fingerprint returns a short non-reversible id so the same secret can be correlated across log lines
+func Fingerprint(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])[:fingerprintLen]
+}
+
+// Secret masks a value keeping its fingerprint
+func Secret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "[REDACTED " + Fingerprint(secret) + "]"
+}
+
+// Value masks a header value, keeping the auth scheme ("Bearer", "Basic") readable
+func Value(name, value string) string {
+	name = http.CanonicalHeaderKey(name)
+
+	switch {
+	case cookieHeaders[name]:
+		return cookies(value)
+	case isHeader(name):
+		if i := strings.IndexByte(value, ' '); i > 0 {
+			return value[:i+1] + Secret(value[i+1:])
+		}
+		return Secret(value)
+	case isClaim(name):
+		return Secret(value)
+	}
+
+	return value
+}
+
+// Header returns a copy of h with credentials masked
+func Header(h http.Header) http.Header {
+	out := make(http.Header, len(h))
+	for name, values := range h {
+		masked := make([]string, len(values))
+		for i, v := range values {
+			masked[i] = Value(name, v)
+		}
+		out[name] = masked
+	}
+
+	return out
+}
+
+// Values masks form fields and query params by claim name
+func Values(v url.Values) url.Values {
+	out := make(url.Values, len(v))
+	for name, values := range v {
+		masked := make([]string, len(values))
+		for i, val := range values {
+			if isClaim(name) {
+				val = Secret(val)
+			}
+			masked[i] = val
+		}
+		out[name] = masked
+	}
+
+	return out
+}
+
+// URL returns the url string with masked query params
+func URL(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+
+	c := *u
+	if c.RawQuery != "" {
+		c.RawQuery = Values(c.Query()).Encode()
+	}
+	if c.User != nil {
+		c.User = url.User(c.User.Username())
+	}
+
+	return c.String()
+}
+
+// URI masks the query params of a request URI, e.g. before it is logged
+func URI(uri string) string {
+	i := strings.Index(uri, "?")
+	if i < 0 {
+		return uri
+	}
+
+	q, err := url.ParseQuery(uri[i+1:])
+	if err != nil {
+		return uri[:i]
+	}
+	for name := range q {
+		if isClaim(name) {
+			return uri[:i+1] + Values(q).Encode()
+		}
+	}
+
+	return uri
+}
+
+// Claims returns a copy of m with claim values masked, nested objects included
+func Claims(m map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		out[k] = claimValue(k, v)
+	}
+
+	return out
+}
+
+func claimValue(key string, v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		return Claims(val)
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for i, item := range val {
+			out[i] = claimValue(key, item)
+		}
+		return out
+	case string:
+		if isClaim(key) {
+			return Secret(val)
+		}
+	}
+
+	if isClaim(key) {
+		return redacted
+	}
+
+	return v
+}
+
+// Body masks a JSON or form encoded body, other content is replaced entirely
+func Body(contentType string, body []byte) []byte {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return body
+	}
+
+	switch {
+	case strings.Contains(contentType, "json"):
+		var v interface{}
+		if err := json.Unmarshal(body, &v); err != nil {
+			break
+		}
+		if m, ok := v.(map[string]interface{}); ok {
+			v = Claims(m)
+		} else {
+			v = claimValue("", v)
+		}
+		b, err := json.Marshal(v)
+		if err == nil {
+			return b
+		}
+	case strings.Contains(contentType, "x-www-form-urlencoded"):
+		v, err := url.ParseQuery(string(body))
+		if err == nil {
+			return []byte(Values(v).Encode())
+		}
+	}
+
+	return []byte(Secret(string(body)))
+}
+
+// DumpRequest is httputil.DumpRequest with credentials masked
+func DumpRequest(req *http.Request, body bool) ([]byte, error) {
+	c := req.Clone(req.Context())
+	c.Header = Header(req.Header)
+	c.URL, _ = url.Parse(URL(req.URL))
+	c.RequestURI = ""
+	c.Body = nil
+
+	if body && req.Body != nil {
+		b, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(b))
+		c.Body = ioutil.NopCloser(bytes.NewReader(Body(req.Header.Get("Content-Type"), b)))
+	}
+
+	return httputil.DumpRequest(c, body)
+}
+
+// DumpResponse is httputil.DumpResponse with credentials masked, resp.Body stays readable
+func DumpResponse(resp *http.Response, body bool) ([]byte, error) {
+	c := *resp
+	c.Header = Header(resp.Header)
+	c.Body = nil
+
+	if body && resp.Body != nil {
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = ioutil.NopCloser(bytes.NewReader(b))
+
+		masked := Body(resp.Header.Get("Content-Type"), b)
+		c.Body = ioutil.NopCloser(bytes.NewReader(masked))
+		c.ContentLength = int64(len(masked))
+	}
+
+	return httputil.DumpResponse(&c, body)
+}
+
+func cookies(value string) string {
+	parts := strings.Split(value, ";")
+	for i, p := range parts {
+		parts[i] = strings.TrimSpace(p)
+		kv := strings.SplitN(parts[i], "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		if i > 0 && isCookieAttribute(kv[0]) {
+			continue
+		}
+		parts[i] = kv[0] + "=" + Secret(kv[1])
+	}
+
+	return strings.Join(parts, "; ")
+}
+
+// Set-Cookie attributes are not secret
+func isCookieAttribute(name string) bool {
+	switch strings.ToLower(name) {
+	case "path", "domain", "expires", "max-age", "samesite":
+		return true
+	}
+	return false
+}
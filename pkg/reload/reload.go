@@ -0,0 +1,131 @@
+package reload
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog/log"
+)
+
+// debounce groups the burst of events editors and kubernetes configmap updates produce
+const debounce = 500 * time.Millisecond
+
+// Handler serves through the most recently stored handler. Requests already being served
+// keep the handler they started with, so swapping never drops in-flight requests.
+type Handler struct {
+	v atomic.Value
+}
+
+type holder struct {
+	h http.Handler
+}
+
+func NewHandler(h http.Handler) *Handler {
+	s := &Handler{}
+	s.Store(h)
+
+	return s
+}
+
+func (s *Handler) Store(h http.Handler) {
+	s.v.Store(holder{h: h})
+}
+
+func (s *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.v.Load().(holder).h.ServeHTTP(w, r)
+}
+
+// Watch calls fn when the file at path changes or SIGHUP is received, until ctx is done.
+// The parent directory is watched so atomic renames and symlink swaps are noticed.
+func Watch(ctx context.Context, path string, fn func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		defer watcher.Close()
+		defer signal.Stop(hup)
+
+		var (
+			timer   *time.Timer
+			trigger = make(chan struct{}, 1)
+			name    = filepath.Clean(path)
+		)
+
+		schedule := func() {
+			if timer != nil {
+				timer.Stop()
+			}
+			timer = time.AfterFunc(debounce, func() {
+				select {
+				case trigger <- struct{}{}:
+				default:
+				}
+			})
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				log.Info().Msg("SIGHUP received, reloading config")
+				fn()
+			case ev, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				// configmap volumes swap a "..data" symlink instead of writing the file
+				if filepath.Clean(ev.Name) == name || filepath.Base(ev.Name) == "..data" {
+					schedule()
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Error().Err(err).Msg("config watcher")
+			case <-trigger:
+				log.Info().Str("file", path).Msg("config file changed, reloading config")
+				fn()
+			}
+		}
+	}()
+
+	return nil
+}
+
+// WatchSignal calls fn on SIGHUP until ctx is done, used when there is no config file to watch
+func WatchSignal(ctx context.Context, fn func()) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		defer signal.Stop(hup)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				log.Info().Msg("SIGHUP received, reloading config")
+				fn()
+			}
+		}
+	}()
+}
@@ -0,0 +1,215 @@
+package route
+
+import (
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"traefik-tower/pkg/forward"
+)
+
+// Rule matches forwarded requests and sets the policy applied to them.
+// Empty match fields match everything, the first matching rule wins.
+type Rule struct {
+	Name       string   `yaml:"name" toml:"name"`
+	Hosts      []string `yaml:"hosts" toml:"hosts"`
+	PathPrefix string   `yaml:"path_prefix" toml:"path_prefix"`
+	Methods    []string `yaml:"methods" toml:"methods"`
+
+	// Public skips authentication
+	Public bool `yaml:"public" toml:"public"`
+	// Roles, when set, requires the consumer to have one of them
+	Roles []string `yaml:"roles" toml:"roles"`
+	// RateLimit, when set, limits the requests of each consumer, role or client ip
+	RateLimit *RateLimit `yaml:"rate_limit" toml:"rate_limit"`
+
+	// DenyCIDRs are client ranges always denied, AllowCIDRs, when set, are the only ranges admitted.
+	// Admitted clients in PublicCIDRs skip authentication, e.g. a VPN range on a route requiring a role.
+	DenyCIDRs   []string `yaml:"deny_cidrs" toml:"deny_cidrs"`
+	AllowCIDRs  []string `yaml:"allow_cidrs" toml:"allow_cidrs"`
+	PublicCIDRs []string `yaml:"public_cidrs" toml:"public_cidrs"`
+}
+
+// Rate limit keys
+const (
+	RateLimitKeyConsumer = "consumer"
+	RateLimitKeyRole     = "role"
+	RateLimitKeyClientIP = "client_ip"
+)
+
+// RateLimit is a token bucket allowing requests per period on average and bursts of up to burst requests
+type RateLimit struct {
+	Requests int           `yaml:"requests" toml:"requests"`
+	Per      time.Duration `yaml:"per" toml:"per"`
+	// Burst is requests when 0
+	Burst int `yaml:"burst" toml:"burst"`
+	// Key is consumer (the default), role or client_ip, requests without one are keyed by client ip
+	Key string `yaml:"key" toml:"key"`
+}
+
+// DefaultName is used for requests that match no rule
+const DefaultName = "default"
+
+type Rules []Rule
+
+// Match returns the first rule matching the forwarded request or nil
+func (rs Rules) Match(host, uri, method string) *Rule {
+	for i := range rs {
+		if rs[i].Match(host, uri, method) {
+			return &rs[i]
+		}
+	}
+
+	return nil
+}
+
+func (r *Rule) Match(host, uri, method string) bool {
+	if len(r.Hosts) > 0 && !MatchHost(r.Hosts, host) {
+		return false
+	}
+
+	if r.PathPrefix != "" && !hasPathPrefix(uri, r.PathPrefix) {
+		return false
+	}
+
+	if len(r.Methods) > 0 && !containsFold(r.Methods, method) {
+		return false
+	}
+
+	return true
+}
+
+// HasRole reports whether the rule allows one of the given roles
+func (r *Rule) HasRole(roles ...string) bool {
+	if len(r.Roles) == 0 {
+		return true
+	}
+
+	for _, role := range roles {
+		if role != "" && containsFold(r.Roles, role) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// HasCIDRs reports whether the rule looks at the client ip
+func (r *Rule) HasCIDRs() bool {
+	return len(r.DenyCIDRs) > 0 || len(r.AllowCIDRs) > 0 || len(r.PublicCIDRs) > 0
+}
+
+// AdmitsIP reports whether the client ip passes the deny and allow lists. A missing or invalid ip
+// is denied by either list, it could be any client.
+func (r *Rule) AdmitsIP(ip string) bool {
+	if len(r.DenyCIDRs) == 0 && len(r.AllowCIDRs) == 0 {
+		return true
+	}
+	if net.ParseIP(ip) == nil || matchCIDR(r.DenyCIDRs, ip) {
+		return false
+	}
+
+	return len(r.AllowCIDRs) == 0 || matchCIDR(r.AllowCIDRs, ip)
+}
+
+// PublicFrom reports whether the client ip skips authentication
+func (r *Rule) PublicFrom(ip string) bool {
+	return matchCIDR(r.PublicCIDRs, ip)
+}
+
+// matchCIDR matches ip against CIDRs and single IPs, they are validated with the config
+func matchCIDR(cidrs []string, ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+
+	for _, c := range cidrs {
+		if ipNet, err := forward.ParseCIDR(c); err == nil && ipNet.Contains(parsed) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// MatchHost matches exact hosts and "*.example.com" wildcards, ports are ignored
+func MatchHost(patterns []string, host string) bool {
+	host = strings.ToLower(stripPort(host))
+
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		if strings.HasPrefix(p, "*.") {
+			if strings.HasSuffix(host, p[1:]) && len(host) > len(p)-1 {
+				return true
+			}
+			continue
+		}
+		if p == host {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hasPathPrefix compares the decoded and cleaned path, "/public/%2e%2e/admin" is "/admin"
+func hasPathPrefix(uri, prefix string) bool {
+	if i := strings.IndexAny(uri, "?#"); i >= 0 {
+		uri = uri[:i]
+	}
+	uri = path.Clean("/" + unescapePath(uri))
+
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" {
+		return true
+	}
+
+	return uri == prefix || strings.HasPrefix(uri, prefix+"/")
+}
+
+// unescapePath decodes the percent escapes of p, malformed escapes are kept as they are
+func unescapePath(p string) string {
+	if !strings.Contains(p, "%") {
+		return p
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		if p[i] == '%' && i+2 < len(p) {
+			if c, err := strconv.ParseUint(p[i+1:i+3], 16, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(p[i])
+	}
+
+	return b.String()
+}
+
+func stripPort(host string) string {
+	if strings.HasPrefix(host, "[") {
+		if i := strings.Index(host, "]"); i > 0 {
+			return host[1:i]
+		}
+	}
+	if i := strings.LastIndex(host, ":"); i >= 0 && strings.Count(host, ":") == 1 {
+		return host[:i]
+	}
+
+	return host
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,35 @@
+package route
+
+import "testing"
+
+func TestAdmitsIP(t *testing.T) {
+	rule := &Rule{DenyCIDRs: []string{"10.8.66.0/24"}, AllowCIDRs: []string{"10.8.0.0/16", "192.168.1.1"}}
+	denyOnly := &Rule{DenyCIDRs: []string{"10.8.66.0/24"}}
+	open := &Rule{PublicCIDRs: []string{"10.8.0.0/16"}}
+
+	tests := []struct {
+		name string
+		rule *Rule
+		ip   string
+		want bool
+	}{
+		{name: "allowed", rule: rule, ip: "10.8.1.1", want: true},
+		{name: "allowed single ip", rule: rule, ip: "192.168.1.1", want: true},
+		{name: "deny overrides allow", rule: rule, ip: "10.8.66.7"},
+		{name: "outside allow list", rule: rule, ip: "203.0.113.7"},
+		{name: "missing ip with allow list", rule: rule},
+		{name: "outside deny list", rule: denyOnly, ip: "203.0.113.7", want: true},
+		{name: "denied", rule: denyOnly, ip: "10.8.66.7"},
+		{name: "missing ip with deny list", rule: denyOnly},
+		{name: "invalid ip with deny list", rule: denyOnly, ip: "10.8.66.7:443"},
+		{name: "no lists", rule: open, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rule.AdmitsIP(tt.ip); got != tt.want {
+				t.Errorf("AdmitsIP(%q) = %t, want %t", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
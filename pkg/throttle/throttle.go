@@ -0,0 +1,215 @@
+package throttle
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxEntries bounds the memory used by failing keys, expired entries are dropped first
+const maxEntries = 100000
+
+// Limiter blocks a key once it failed max times within the window. The first block lasts one window,
+// each following block twice as long as the previous one up to maxBlock. A key that is not blocked
+// again for maxBlock after its last block starts over.
+type Limiter struct {
+	max      int
+	window   time.Duration
+	maxBlock time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*entry
+}
+
+type entry struct {
+	failures int
+	// reset ends the window counting failures
+	reset time.Time
+	// until ends the block
+	until   time.Time
+	strikes int
+}
+
+// Entry is a blocked key
+type Entry struct {
+	Key     string    `json:"key"`
+	Until   time.Time `json:"blocked_until"`
+	Strikes int       `json:"blocks"`
+}
+
+// New returns a limiter blocking for one window, max 0 never blocks
+func New(max int, window time.Duration) *Limiter {
+	return NewBackoff(max, window, window)
+}
+
+// NewBackoff returns a limiter doubling the blocks of repeat offenders up to maxBlock, max 0 never blocks
+func NewBackoff(max int, window, maxBlock time.Duration) *Limiter {
+	if maxBlock < window {
+		maxBlock = window
+	}
+	return &Limiter{max: max, window: window, maxBlock: maxBlock, entries: map[string]*entry{}}
+}
+
+// Blocked reports whether key is blocked and for how long
+func (l *Limiter) Blocked(key string) (bool, time.Duration) {
+	if l == nil || l.max <= 0 {
+		return false, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e, ok := l.entries[key]
+	if !ok {
+		return false, 0
+	}
+	now := time.Now()
+	if now.Before(e.until) {
+		return true, e.until.Sub(now)
+	}
+	if l.expired(e, now) {
+		delete(l.entries, key)
+	}
+
+	return false, 0
+}
+
+// Fail counts a failed attempt, the window starts with the first failure. It reports whether
+// the failure started a block.
+func (l *Limiter) Fail(key string) bool {
+	if l == nil || l.max <= 0 {
+		return false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	e, ok := l.entries[key]
+	if !ok {
+		if len(l.entries) >= maxEntries {
+			l.purge(now)
+		}
+		e = &entry{}
+		l.entries[key] = e
+	}
+	if !now.Before(e.until.Add(l.maxBlock)) {
+		e.strikes = 0
+	}
+	if !now.Before(e.reset) {
+		e.failures = 0
+		e.reset = now.Add(l.window)
+	}
+
+	e.failures++
+	if e.failures < l.max {
+		return false
+	}
+
+	block := l.window
+	for i := 0; i < e.strikes && block < l.maxBlock; i++ {
+		block *= 2
+	}
+	if block > l.maxBlock {
+		block = l.maxBlock
+	}
+	e.until = now.Add(block)
+	e.strikes++
+	e.failures = 0
+	e.reset = e.until
+
+	return true
+}
+
+// Success forgets the failures of key
+func (l *Limiter) Success(key string) {
+	if l == nil || l.max <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	delete(l.entries, key)
+	l.mu.Unlock()
+}
+
+// Unblock forgets key, it reports whether key was blocked
+func (l *Limiter) Unblock(key string) bool {
+	if l == nil {
+		return false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e, ok := l.entries[key]
+	delete(l.entries, key)
+
+	return ok && time.Now().Before(e.until)
+}
+
+// BlockedKeys lists the blocked keys sorted by key
+func (l *Limiter) BlockedKeys() []Entry {
+	list := []Entry{}
+	if l == nil {
+		return list
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	for k, e := range l.entries {
+		if now.Before(e.until) {
+			list = append(list, Entry{Key: k, Until: e.until, Strikes: e.strikes})
+		}
+	}
+	l.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+
+	return list
+}
+
+// BlockedCount returns the number of blocked keys
+func (l *Limiter) BlockedCount() int {
+	if l == nil {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	n, now := 0, time.Now()
+	for _, e := range l.entries {
+		if now.Before(e.until) {
+			n++
+		}
+	}
+
+	return n
+}
+
+// expired reports whether the entry neither counts failures nor blocks nor remembers a recent block
+func (l *Limiter) expired(e *entry, now time.Time) bool {
+	return !now.Before(e.reset) && !now.Before(e.until.Add(l.maxBlock))
+}
+
+// purge drops expired entries, or random ones when none expired
+func (l *Limiter) purge(now time.Time) {
+	for k, e := range l.entries {
+		if l.expired(e, now) {
+			delete(l.entries, k)
+		}
+	}
+	if len(l.entries) < maxEntries {
+		return
+	}
+
+	// the map iteration order is random, dropping a tenth keeps the cost amortized
+	n := maxEntries / 10
+	for k := range l.entries {
+		if n == 0 {
+			break
+		}
+		delete(l.entries, k)
+		n--
+	}
+}
@@ -1,92 +1,121 @@
 package tracer
 
 import (
+	"context"
 	"net/http"
 
-	"github.com/opentracing/opentracing-go"
-	"github.com/opentracing/opentracing-go/ext"
-	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
+const instrumentationName = "traefik-tower"
+
+// Span attribute keys, kept compatible with the ones set by the opentracing ext package
+const (
+	AttrHTTPURL        = attribute.Key("http.url")
+	AttrHTTPMethod     = attribute.Key("http.method")
+	AttrHTTPStatusCode = attribute.Key("http.status_code")
+	AttrTenant         = attribute.Key("tenant")
+)
+
+// ITracer starts the spans of an auth request. The spans live in the request context, a Tracer is
+// shared by concurrent requests.
 type ITracer interface {
-	GetTracer() opentracing.Tracer
-	GetParentSpan() opentracing.Span
-	GetChildSpan() opentracing.Span
-	IsParentSpan() bool
-	IsChildSpan() bool
-
-	Parent(req *http.Request)
-	Child(req *http.Request) error
-	ExtURL(span opentracing.Span, method string, url string)
-	ExtStatus(span opentracing.Span, status int)
-	Finish()
+	GetTracer() trace.Tracer
+
+	Parent(req *http.Request) *http.Request
+	Child(ctx context.Context, req *http.Request) trace.Span
+	Inject(span trace.Span, req *http.Request)
+	ExtURL(span trace.Span, method string, url string)
+	ExtStatus(span trace.Span, status int)
+	Finish(req *http.Request)
 }
 
 type Tracer struct {
-	tracer     opentracing.Tracer
-	parentSpan opentracing.Span
-	childSpan  opentracing.Span
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+	attrs      []attribute.KeyValue
 }
 
-func NewTracer(tracer opentracing.Tracer) *Tracer {
-	opentracing.SetGlobalTracer(tracer)
+// NewTracer uses the global tracer provider and propagator, see Init.
+// attrs are set on every span started by the tracer.
+func NewTracer(attrs ...attribute.KeyValue) *Tracer {
 	return &Tracer{
-		tracer: opentracing.GlobalTracer(),
+		tracer:     otel.Tracer(instrumentationName),
+		propagator: otel.GetTextMapPropagator(),
+		attrs:      attrs,
 	}
 }
 
-func (t *Tracer) Finish() {
-	if t.parentSpan != nil {
-		t.parentSpan.Finish()
-		t.parentSpan = nil
-	}
-
-	if t.childSpan != nil {
-		t.childSpan.Finish()
-		t.childSpan = nil
-	}
+// Parent starts the server span of req, continuing the trace of the proxy. The returned request
+// carries the span, end it with Finish.
+func (t *Tracer) Parent(req *http.Request) *http.Request {
+	ctx := t.propagator.Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+	ctx, _ = t.tracer.Start(ctx, req.URL.Path,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(t.attrs...),
+	)
+	return req.WithContext(ctx)
 }
 
-func (t *Tracer) IsParentSpan() bool {
-	return t.parentSpan != nil
-}
+// Child starts a client span for the upstream request req below the parent span in ctx. Without a
+// parent span it returns a span that records nothing. The caller ends the span.
+func (t *Tracer) Child(ctx context.Context, req *http.Request) trace.Span {
+	parent := trace.SpanFromContext(ctx)
+	if !parent.SpanContext().IsValid() {
+		return parent
+	}
 
-func (t *Tracer) IsChildSpan() bool {
-	return t.childSpan != nil
+	_, span := t.tracer.Start(ctx, req.URL.Path,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(t.attrs...),
+	)
+	return span
 }
 
-func (t *Tracer) Parent(req *http.Request) {
-	spanCtx, _ := t.tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(req.Header))
-	t.parentSpan = t.tracer.StartSpan(req.URL.Path, ext.RPCServerOption(spanCtx))
+// Finish ends the parent span of req
+func (t *Tracer) Finish(req *http.Request) {
+	trace.SpanFromContext(req.Context()).End()
 }
 
-func (t *Tracer) Child(req *http.Request) error {
-	if t.parentSpan == nil {
-		return errors.New("not find opentracing.SpanContext")
+// Inject writes the span context into the outgoing request headers using the configured propagators
+func (t *Tracer) Inject(span trace.Span, req *http.Request) {
+	if !span.SpanContext().IsValid() {
+		return
 	}
 
-	t.childSpan = t.tracer.StartSpan(req.URL.Path, opentracing.ChildOf(t.parentSpan.Context()))
-	return nil
+	ctx := trace.ContextWithSpan(req.Context(), span)
+	t.propagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
 }
 
-func (t *Tracer) ExtStatus(span opentracing.Span, status int) {
-	ext.HTTPStatusCode.Set(span, uint16(status))
+func (t *Tracer) ExtStatus(span trace.Span, status int) {
+	span.SetAttributes(AttrHTTPStatusCode.Int(status))
 }
 
-func (t *Tracer) ExtURL(span opentracing.Span, method, url string) {
-	ext.SpanKindRPCClient.Set(span)
-	ext.HTTPUrl.Set(span, url)
-	ext.HTTPMethod.Set(span, method)
+func (t *Tracer) ExtURL(span trace.Span, method, url string) {
+	span.SetAttributes(
+		AttrHTTPURL.String(url),
+		AttrHTTPMethod.String(method),
+	)
 }
 
-func (t *Tracer) GetTracer() opentracing.Tracer {
+func (t *Tracer) GetTracer() trace.Tracer {
 	return t.tracer
 }
 
-func (t *Tracer) GetParentSpan() opentracing.Span {
-	return t.parentSpan
+// Span returns the parent span carried by ctx, a span that records nothing when there is none
+func Span(ctx context.Context) trace.Span {
+	return trace.SpanFromContext(ctx)
 }
 
-func (t *Tracer) GetChildSpan() opentracing.Span {
-	return t.childSpan
+// TraceID returns the trace id of the span carried by ctx or an empty string
+func TraceID(ctx context.Context) string {
+	sc := trace.SpanFromContext(ctx).SpanContext()
+	if !sc.HasTraceID() {
+		return ""
+	}
+
+	return sc.TraceID().String()
 }
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog/log"
+
+	"traefik-tower/config"
+	"traefik-tower/handlers"
+	"traefik-tower/pkg/accesslog"
+	"traefik-tower/pkg/acp"
+	"traefik-tower/pkg/apikey"
+	"traefik-tower/pkg/audit"
+	"traefik-tower/pkg/cache"
+	"traefik-tower/pkg/client"
+	"traefik-tower/pkg/forward"
+	"traefik-tower/pkg/htpasswd"
+	"traefik-tower/pkg/ldapauth"
+	"traefik-tower/pkg/login"
+	"traefik-tower/pkg/mtls"
+	"traefik-tower/pkg/ratelimit"
+	"traefik-tower/pkg/throttle"
+	"traefik-tower/pkg/tracer"
+	"traefik-tower/services"
+)
+
+// sharedDeps live for the whole process and are reused by every router built on reload
+type sharedDeps struct {
+	accessLog *accesslog.Logger
+	auditor   *audit.Auditor
+	limits    ratelimit.Store
+	// blocks are the client blocks of the last router built, read by the blocked clients metric
+	blocks atomic.Pointer[throttle.Limiter]
+	// kept holds the stateful components of the auth handlers, e.g. failure counters and caches
+	kept kept
+}
+
+// kept reuses stateful components across reloads. Components are keyed by the settings they are
+// built from, a reload keeps the ones its config still uses and closes the others once it is in place.
+type kept struct {
+	mu   sync.Mutex
+	live map[string]interface{}
+	next map[string]interface{}
+}
+
+// get returns the component of key, built by create when the current router has none
+func (k *kept) get(key string, create func() (interface{}, error)) (interface{}, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.next == nil {
+		k.next = map[string]interface{}{}
+	}
+	if v, ok := k.next[key]; ok {
+		return v, nil
+	}
+	v, ok := k.live[key]
+	if !ok {
+		var err error
+		if v, err = create(); err != nil {
+			return nil, err
+		}
+	}
+	k.next[key] = v
+
+	return v, nil
+}
+
+// commit is called once the new router serves requests, components it does not use are closed
+func (k *kept) commit() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	closeUnused(k.live, k.next)
+	k.live, k.next = k.next, nil
+}
+
+// discard is called when building the new router failed, components only it used are closed
+func (k *kept) discard() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	closeUnused(k.next, k.live)
+	k.next = nil
+}
+
+func closeUnused(components, used map[string]interface{}) {
+	for key, v := range components {
+		if _, ok := used[key]; ok {
+			continue
+		}
+		if c, ok := v.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				log.Error().Err(err).Str("component", key).Msg("close")
+			}
+		}
+	}
+}
+
+// newRouter builds services and handlers for cfg and each of its tenants
+func newRouter(cfg *config.Config, shared *sharedDeps) (http.Handler, error) {
+	h, tenants, err := newTenantRouter(cfg, shared)
+	if err != nil {
+		return nil, err
+	}
+
+	normalizer, err := forward.NewNormalizer(cfg.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	blocks, err := bruteForce(cfg, shared)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		authRoot   http.Handler = tenants
+		authTenant http.Handler = http.HandlerFunc(tenants.ByPath)
+	)
+
+	routerHandler := mux.NewRouter()
+
+	// browser login, the session cookie is turned into a bearer token before the auth handlers
+	if cfg.Login {
+		l, err := newLogin(cfg)
+		if err != nil {
+			return nil, err
+		}
+		authRoot, authTenant = l.Handler(authRoot), l.Handler(authTenant)
+		routerHandler.HandleFunc("/callback", l.Callback)
+	}
+
+	routerHandler.Handle("/", forward.Handler(normalizer, authRoot))
+	routerHandler.Handle("/t/{"+handlers.PathVarTenant+"}", forward.Handler(normalizer, authTenant))
+
+	if cfg.AdminToken != "" {
+		admin := handlers.NewAdmin(cfg.AdminToken, tenants, blocks)
+		routerHandler.HandleFunc("/admin/explain", admin.Auth(admin.Explain)).Methods(http.MethodPost)
+		routerHandler.HandleFunc("/admin/blocks", admin.Auth(admin.Blocks)).Methods(http.MethodGet)
+		routerHandler.HandleFunc("/admin/blocks/{"+handlers.PathVarClientIP+"}", admin.Auth(admin.Unblock)).Methods(http.MethodDelete)
+	}
+
+	routerHandler.HandleFunc("/health", h.Health())
+	routerHandler.Handle("/metrics", promhttp.Handler())
+	if cfg.Debug {
+		routerHandler.HandleFunc("/200", h.AlwaysSuccess)
+		routerHandler.HandleFunc("/404", h.AlwaysFail)
+	}
+
+	shared.blocks.Store(blocks)
+
+	return routerHandler, nil
+}
+
+// newTenantRouter builds the auth handlers of cfg and each of its tenants
+func newTenantRouter(cfg *config.Config, shared *sharedDeps) (*handlers.Handlers, *handlers.TenantRouter, error) {
+	h, authHandler, err := newAuthHandler(cfg, shared)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tenants := handlers.NewTenantRouter(authHandler)
+	for i := range cfg.Tenants {
+		t := &cfg.Tenants[i]
+		_, th, err := newAuthHandler(cfg.ForTenant(t), shared)
+		if err != nil {
+			return nil, nil, fmt.Errorf("tenant %s: %w", t.Name, err)
+		}
+		tenants.Add(t.Name, t.Hosts, th)
+	}
+
+	return h, tenants, nil
+}
+
+func newLogin(cfg *config.Config) (*login.Login, error) {
+	return login.New(login.Options{
+		AuthorizeURL: cfg.LoginAuthorizeURL,
+		TokenURL:     cfg.LoginTokenURL,
+		ClientID:     cfg.LoginClientID,
+		ClientSecret: cfg.LoginClientSecret,
+		RedirectURL:  cfg.LoginRedirectURL,
+		Scopes:       cfg.LoginScopes,
+		CookieName:   cfg.LoginCookieName,
+		CookieDomain: cfg.LoginCookieDomain,
+		CookieSecure: cfg.LoginCookieSecure,
+		CookieSecret: cfg.LoginCookieSecret,
+		SessionTTL:   cfg.LoginSessionTTL,
+	})
+}
+
+// basicThrottle returns the failure counters of the tenant, kept while the limits are unchanged
+func basicThrottle(cfg *config.Config, shared *sharedDeps) (*throttle.Limiter, error) {
+	key := fmt.Sprintf("basic_throttle|%s|%d|%s", cfg.Tenant, cfg.BasicAuthMaxFailures, cfg.BasicAuthFailureWindow)
+	v, err := shared.kept.get(key, func() (interface{}, error) {
+		return throttle.New(cfg.BasicAuthMaxFailures, cfg.BasicAuthFailureWindow), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*throttle.Limiter), nil
+}
+
+// bruteForce returns the client blocks shared by all tenants, kept while the bruteforce settings are unchanged
+func bruteForce(cfg *config.Config, shared *sharedDeps) (*throttle.Limiter, error) {
+	key := fmt.Sprintf("bruteforce|%d|%s|%s", cfg.BruteForceMaxFailures, cfg.BruteForceWindow, cfg.BruteForceMaxBlock)
+	v, err := shared.kept.get(key, func() (interface{}, error) {
+		return throttle.NewBackoff(cfg.BruteForceMaxFailures, cfg.BruteForceWindow, cfg.BruteForceMaxBlock), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*throttle.Limiter), nil
+}
+
+// sessionCache returns the Kratos session cache shared by all tenants, cached sessions are keyed by the
+// kratos url. It is kept while its size is unchanged.
+func sessionCache(cfg *config.Config, shared *sharedDeps) (*cache.Cache, error) {
+	v, err := shared.kept.get(fmt.Sprintf("kratos_sessions|%d", cfg.KratosCacheSize), func() (interface{}, error) {
+		return cache.New("kratos_sessions", cfg.KratosCacheSize), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*cache.Cache), nil
+}
+
+// modTime versions a file in the keys of kept components, empty when it is not set or missing
+func modTime(path string) string {
+	if path == "" {
+		return ""
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+	return fi.ModTime().String()
+}
+
+// newAuthHandler builds the services and the forward auth handler of one auth type
+func newAuthHandler(cfg *config.Config, shared *sharedDeps) (*handlers.Handlers, http.HandlerFunc, error) {
+	var (
+		err        error
+		httpClient *client.HTTPClient
+		pools      []*services.CognitoPool
+	)
+
+	if cfg.IsAuthServiceURL() {
+		// http client
+		httpClient, err = client.NewClient(cfg.AuthServerURL)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else if cfg.KetoURL != "" {
+		// keto is the only http backend, e.g. mtls-keto
+		httpClient, err = client.NewClient(cfg.KetoURL)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else if cfg.AuthType == config.AuthTypeCognitoAWS {
+		// one client per user pool, pools may live in different regions and accounts
+		for _, p := range cfg.CognitoUserPools() {
+			cn, err := cognitoAwsConnected(p.GetRegion(), p.Profile)
+			if err != nil {
+				return nil, nil, err
+			}
+			pools = append(pools, &services.CognitoPool{
+				Name:         p.Name,
+				Issuer:       p.Issuer(),
+				AppClientIDs: p.AppClientIDs,
+				Client:       cn,
+			})
+		}
+	}
+
+	var tr *tracer.Tracer
+	if cfg.Tenant != "" {
+		tr = tracer.NewTracer(tracer.AttrTenant.String(cfg.Tenant))
+	} else {
+		tr = tracer.NewTracer()
+	}
+
+	// services
+	srv := services.NewService(cfg, httpClient, tr, pools)
+	if srv.SessionCache, err = sessionCache(cfg, shared); err != nil {
+		return nil, nil, err
+	}
+	if srv.BruteForce, err = bruteForce(cfg, shared); err != nil {
+		return nil, nil, err
+	}
+	srv.RateLimits = shared.limits
+	if cfg.OPAURL != "" {
+		if srv.OPA, err = client.NewClient(cfg.OPAURL); err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(cfg.ACPPolicies) > 0 {
+		if srv.ACP, err = acp.Load(cfg.ACPFlavor, cfg.ACPPolicies); err != nil {
+			return nil, nil, err
+		}
+	}
+	switch cfg.AuthType {
+	case config.AuthTypeAPIKey:
+		if srv.APIKeys, err = apikey.Open(cfg.APIKeyFile); err != nil {
+			return nil, nil, err
+		}
+	case config.AuthTypeMTLS, config.AuthTypeMTLSKeto:
+		if srv.MTLS, err = mtls.NewVerifier(cfg.MTLSCAFiles, cfg.MTLSCRLFiles); err != nil {
+			return nil, nil, err
+		}
+	case config.AuthTypeBasic, config.AuthTypeBasicKeto:
+		if srv.Htpasswd, err = htpasswd.Open(cfg.BasicAuthFile, cfg.BasicAuthGroupFile); err != nil {
+			return nil, nil, err
+		}
+		if srv.BasicThrottle, err = basicThrottle(cfg, shared); err != nil {
+			return nil, nil, err
+		}
+	case config.AuthTypeLDAP, config.AuthTypeLDAPKeto:
+		ldapOptions := ldapauth.Options{
+			URL:                cfg.LDAPURL,
+			StartTLS:           cfg.LDAPStartTLS,
+			CAFile:             cfg.LDAPCAFile,
+			BindDN:             cfg.LDAPBindDN,
+			BindPassword:       cfg.LDAPBindPassword,
+			BaseDN:             cfg.LDAPBaseDN,
+			UserFilter:         cfg.LDAPUserFilter,
+			GroupAttribute:     cfg.LDAPGroupAttribute,
+			GroupBaseDN:        cfg.LDAPGroupBaseDN,
+			GroupFilter:        cfg.LDAPGroupFilter,
+			GroupNameAttribute: cfg.LDAPGroupNameAttribute,
+			PoolSize:           cfg.LDAPPoolSize,
+			Timeout:            cfg.LDAPTimeout,
+		}
+		// the connection pool and the bind cache are kept while the directory settings and the CA file are unchanged
+		ldapKey := fmt.Sprintf("%s|%+v|%s", cfg.Tenant, ldapOptions, modTime(cfg.LDAPCAFile))
+		authenticator, err := shared.kept.get("ldap|"+ldapKey, func() (interface{}, error) { return ldapauth.New(ldapOptions) })
+		if err != nil {
+			return nil, nil, err
+		}
+		srv.LDAP = authenticator.(*ldapauth.Authenticator)
+		bindCache, err := shared.kept.get(fmt.Sprintf("ldap_binds|%s|%d", ldapKey, cfg.LDAPCacheSize),
+			func() (interface{}, error) { return cache.New("ldap_binds", cfg.LDAPCacheSize), nil })
+		if err != nil {
+			return nil, nil, err
+		}
+		srv.BindCache = bindCache.(*cache.Cache)
+		if srv.BasicThrottle, err = basicThrottle(cfg, shared); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// handlers
+	h := handlers.NewHandlers(cfg, srv, shared.accessLog, shared.auditor)
+	switch cfg.AuthType {
+	case config.AuthTypeCognito:
+		return h, h.Cognito, nil
+	case config.AuthTypeCognitoAWS:
+		return h, h.CognitoAWS, nil
+	case config.AuthTypeHydraKeto:
+		return h, h.HydraKeto, nil
+	case config.AuthTypeHydra:
+		return h, h.Hydra, nil
+	case config.AuthTypeKratos:
+		return h, h.Kratos, nil
+	case config.AuthTypeKratosKeto:
+		return h, h.KratosKeto, nil
+	case config.AuthTypeAPIKey:
+		return h, h.APIKey, nil
+	case config.AuthTypeMTLS:
+		return h, h.MTLS, nil
+	case config.AuthTypeMTLSKeto:
+		return h, h.MTLSKeto, nil
+	case config.AuthTypeBasic:
+		return h, h.Basic, nil
+	case config.AuthTypeBasicKeto:
+		return h, h.BasicKeto, nil
+	case config.AuthTypeLDAP:
+		return h, h.LDAP, nil
+	case config.AuthTypeLDAPKeto:
+		return h, h.LDAPKeto, nil
+	}
+
+	return nil, nil, fmt.Errorf("unknown auth type %q", cfg.AuthType)
+}
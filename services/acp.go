@@ -0,0 +1,38 @@
+package services
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"traefik-tower/pkg/acp"
+	"traefik-tower/pkg/decision"
+	"traefik-tower/pkg/tracer"
+)
+
+// ACPAllowed evaluates the request against the in process ACP policies, it replaces HydraKetoAllowed
+// when policies are configured
+func (s *Service) ACPAllowed(req *http.Request, subject string) error {
+	rec := decision.FromContext(req.Context())
+	defer rec.ObserveStage(decision.StageACP, time.Now())
+
+	parent := tracer.Span(req.Context())
+
+	ar := ketoRequest(req, subject)
+	allowed, matched := s.ACP.Allowed(ar.Subject, ar.Resource, ar.Action)
+	rec.Step(decision.StageACP, ar, map[string]interface{}{"allowed": allowed, "policies": acp.SortedIDs(matched)})
+
+	if s.cfg.Debug {
+		log.Debug().Msgf("ACPAllowed::authRequest %v allowed=%t policies=%v", ar, allowed, acp.SortedIDs(matched))
+	}
+
+	if !allowed {
+		rec.SetReason(decision.ReasonPolicyDenied)
+		s.Tracer.ExtStatus(parent, http.StatusUnauthorized)
+		return ErrUnauthorized
+	}
+	s.Tracer.ExtStatus(parent, http.StatusOK)
+
+	return nil
+}
@@ -0,0 +1,81 @@
+package services
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"traefik-tower/pkg/apikey"
+	"traefik-tower/pkg/audit"
+	"traefik-tower/pkg/decision"
+	"traefik-tower/pkg/forward"
+	"traefik-tower/pkg/tracer"
+)
+
+// APIKey checks the key from the configured header or query param of the forwarded URI against the key store
+func (s *Service) APIKey(req *http.Request) (*apikey.Key, error) {
+	rec := decision.FromContext(req.Context())
+	defer rec.ObserveStage(decision.StageAPIKey, time.Now())
+
+	parent := tracer.Span(req.Context())
+	s.Tracer.ExtURL(parent, req.Method, "/")
+
+	plain := s.apiKeyFromRequest(req)
+	if plain == "" {
+		rec.SetReason(decision.ReasonMissingToken)
+		return nil, ErrUnauthorized
+	}
+	rec.TokenHash = audit.HashToken(plain)
+
+	if s.APIKeys == nil {
+		rec.SetReason(decision.ReasonNotConfigured)
+		s.Tracer.ExtStatus(parent, http.StatusInternalServerError)
+		return nil, ErrInternalServerError
+	}
+
+	key, err := s.APIKeys.Lookup(plain)
+	switch err {
+	case nil:
+	case apikey.ErrRevoked, apikey.ErrExpired:
+		rec.SetReason(decision.ReasonInactiveToken)
+	default:
+		rec.SetReason(decision.ReasonUnknownClient)
+	}
+	if err != nil {
+		s.Tracer.ExtStatus(parent, http.StatusUnauthorized)
+		return nil, ErrUnauthorized
+	}
+
+	if !key.AllowsRoute(rec.Route) {
+		rec.SetReason(decision.ReasonRouteDenied)
+		s.Tracer.ExtStatus(parent, http.StatusUnauthorized)
+		return nil, ErrUnauthorized
+	}
+
+	rec.Step(decision.StageAPIKey, nil, map[string]interface{}{"key_id": key.ID, "owner": key.Owner, "roles": key.Roles, "scopes": key.Scopes})
+	rec.SetRoles(key.Roles)
+	rec.Claims = map[string]interface{}{"key_id": key.ID, "owner": key.Owner, "scopes": key.Scopes}
+	s.Tracer.ExtStatus(parent, http.StatusOK)
+
+	return key, nil
+}
+
+func (s *Service) apiKeyFromRequest(req *http.Request) string {
+	if s.cfg.APIKeyHeader != "" {
+		if v := req.Header.Get(s.cfg.APIKeyHeader); v != "" {
+			return v
+		}
+	}
+
+	if s.cfg.APIKeyQueryParam != "" {
+		uri := forward.FromContext(req.Context()).URI
+		if i := strings.Index(uri, "?"); i >= 0 {
+			if q, err := url.ParseQuery(uri[i+1:]); err == nil {
+				return q.Get(s.cfg.APIKeyQueryParam)
+			}
+		}
+	}
+
+	return ""
+}
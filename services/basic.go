@@ -0,0 +1,97 @@
+package services
+
+import (
+	"net/http"
+	"time"
+
+	"traefik-tower/pkg/audit"
+	"traefik-tower/pkg/decision"
+	"traefik-tower/pkg/forward"
+	"traefik-tower/pkg/tracer"
+)
+
+// BasicAuth checks the basic auth credentials against the htpasswd file, the groups of the user are its roles
+func (s *Service) BasicAuth(req *http.Request) (*ConsumerID, error) {
+	rec := decision.FromContext(req.Context())
+	defer rec.ObserveStage(decision.StageBasic, time.Now())
+
+	if s.Htpasswd == nil {
+		return s.basicAuth(req, nil)
+	}
+
+	return s.basicAuth(req, func(user, password string) ([]string, error) {
+		valid := s.Htpasswd.Authenticate(user, password)
+		rec.Step(decision.StageBasic, map[string]string{"user": user}, map[string]bool{"valid": valid})
+		if !valid {
+			rec.SetReason(decision.ReasonUnknownClient)
+			return nil, ErrUnauthorized
+		}
+		return s.Htpasswd.Groups(user), nil
+	})
+}
+
+// basicAuth reads and throttles basic credentials. check returns the groups of a valid user, ErrUnauthorized
+// counts as a failed attempt. A nil check means the backend is not configured.
+func (s *Service) basicAuth(req *http.Request, check func(user, password string) ([]string, error)) (*ConsumerID, error) {
+	rec := decision.FromContext(req.Context())
+
+	parent := tracer.Span(req.Context())
+	s.Tracer.ExtURL(parent, req.Method, "/")
+
+	user, password, ok := req.BasicAuth()
+	if !ok || user == "" {
+		rec.SetReason(decision.ReasonMissingToken)
+		return nil, ErrUnauthorized
+	}
+	// a hash of the password would be open to offline guessing, the user identifies the credential
+	rec.TokenHash = audit.HashToken(user)
+
+	if check == nil {
+		rec.SetReason(decision.ReasonNotConfigured)
+		s.Tracer.ExtStatus(parent, http.StatusInternalServerError)
+		return nil, ErrInternalServerError
+	}
+
+	key := basicThrottleKey(req, user)
+	if blocked, _ := s.BasicThrottle.Blocked(key); blocked {
+		rec.SetReason(decision.ReasonThrottled)
+		s.Tracer.ExtStatus(parent, http.StatusTooManyRequests)
+		return nil, ErrTooManyRequests
+	}
+
+	// dry runs leave the failure counters alone
+	limiter := s.BasicThrottle
+	if rec.DryRun() {
+		limiter = nil
+	}
+
+	groups, err := check(user, password)
+	if err == ErrUnauthorized {
+		limiter.Fail(key)
+		s.Tracer.ExtStatus(parent, http.StatusUnauthorized)
+		return nil, err
+	}
+	if err != nil {
+		s.Tracer.ExtStatus(parent, http.StatusInternalServerError)
+		return nil, err
+	}
+	limiter.Success(key)
+
+	rec.SetRoles(groups)
+	rec.Claims = map[string]interface{}{"user": user, "groups": groups}
+	cID := ConsumerID(user)
+	s.Tracer.ExtStatus(parent, http.StatusOK)
+
+	return &cID, nil
+}
+
+// BasicRetryAfter returns how long the user of the request stays throttled
+func (s *Service) BasicRetryAfter(req *http.Request) time.Duration {
+	user, _, _ := req.BasicAuth()
+	_, d := s.BasicThrottle.Blocked(basicThrottleKey(req, user))
+	return d
+}
+
+func basicThrottleKey(req *http.Request, user string) string {
+	return user + "|" + forward.FromContext(req.Context()).ClientIP
+}
@@ -0,0 +1,48 @@
+package services
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"traefik-tower/pkg/decision"
+	"traefik-tower/pkg/metrics"
+)
+
+// invalidCredentialReasons are the denials caused by a credential the identity provider had to check
+var invalidCredentialReasons = map[string]bool{
+	decision.ReasonInactiveToken:  true,
+	decision.ReasonUnknownClient:  true,
+	decision.ReasonUnknownSubject: true,
+	decision.ReasonUnknownIssuer:  true,
+}
+
+// BruteForceBlocked returns ErrTooManyRequests and the remaining block time when the client ip is blocked
+// for sending invalid credentials. It is checked before any upstream call.
+func (s *Service) BruteForceBlocked(req *http.Request) (time.Duration, error) {
+	rec := decision.FromContext(req.Context())
+	if rec.ClientIP == "" {
+		return 0, nil
+	}
+
+	blocked, d := s.BruteForce.Blocked(rec.ClientIP)
+	if !blocked {
+		return 0, nil
+	}
+	rec.SetReason(decision.ReasonThrottled)
+
+	return d, ErrTooManyRequests
+}
+
+// BruteForceCount counts the denial of an invalid credential against the client ip
+func (s *Service) BruteForceCount(rec *decision.Record) {
+	if rec.DryRun() || rec.ClientIP == "" || rec.Outcome != decision.OutcomeDeny || !invalidCredentialReasons[rec.Reason] {
+		return
+	}
+
+	if s.BruteForce.Fail(rec.ClientIP) {
+		metrics.ClientBlocks.Inc()
+		log.Warn().Str("client_ip", rec.ClientIP).Str("tenant", rec.Tenant).Msg("client blocked for invalid credentials")
+	}
+}
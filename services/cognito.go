@@ -0,0 +1,81 @@
+package services
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+
+	cognito "github.com/aws/aws-sdk-go/service/cognitoidentityprovider"
+
+	"traefik-tower/pkg/decision"
+)
+
+// CognitoPool is a user pool with an SDK client bound to its region
+type CognitoPool struct {
+	Name         string
+	Issuer       string
+	AppClientIDs []string
+	Client       *cognito.CognitoIdentityProvider
+}
+
+type cognitoTokenClaims struct {
+	Iss      string `json:"iss"`
+	ClientID string `json:"client_id"`
+	Aud      string `json:"aud"`
+}
+
+// cognitoPool selects the pool by the token iss claim. The claims are read without verifying
+// the signature, GetUser validates the token against the pool afterwards.
+func (s *Service) cognitoPool(token string) (*CognitoPool, string) {
+	claims, err := unverifiedClaims(token)
+	if err != nil {
+		return nil, decision.ReasonInactiveToken
+	}
+
+	// access tokens carry client_id, id tokens aud
+	clientID := claims.ClientID
+	if clientID == "" {
+		clientID = claims.Aud
+	}
+
+	for _, p := range s.CognitoPools {
+		if p.Issuer != claims.Iss {
+			continue
+		}
+		if len(p.AppClientIDs) > 0 && !contains(p.AppClientIDs, clientID) {
+			return nil, decision.ReasonUnknownClient
+		}
+		return p, ""
+	}
+
+	return nil, decision.ReasonUnknownIssuer
+}
+
+func unverifiedClaims(token string) (*cognitoTokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrUnauthorized
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, err
+	}
+
+	claims := &cognitoTokenClaims{}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,115 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+
+	"traefik-tower/pkg/client"
+	"traefik-tower/pkg/decision"
+	"traefik-tower/pkg/redact"
+	"traefik-tower/pkg/tracer"
+)
+
+// HeaderXSessionToken carries the Kratos session token of API clients
+const HeaderXSessionToken = "X-Session-Token"
+
+// KratosSession is the part of the Kratos session the tower uses
+type KratosSession struct {
+	ID        string    `json:"id"`
+	Active    bool      `json:"active"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Identity  struct {
+		ID     string                 `json:"id"`
+		Traits map[string]interface{} `json:"traits"`
+	} `json:"identity"`
+}
+
+// claims are the identity id, the session id and the traits
+func (ks *KratosSession) claims() map[string]interface{} {
+	return map[string]interface{}{"sub": ks.Identity.ID, "session_id": ks.ID, "traits": ks.Identity.Traits}
+}
+
+// Trait returns a top level trait as a string, empty when missing or not a string
+func (ks *KratosSession) Trait(name string) string {
+	v, _ := ks.Identity.Traits[name].(string)
+	return v
+}
+
+// KratosWhoami resolves the session cookie or token of the request with Kratos /sessions/whoami.
+// Sessions are cached until they expire, at most KratosCacheTTL when it is set.
+func (s *Service) KratosWhoami(req *http.Request) (*KratosSession, error) {
+	rec := decision.FromContext(req.Context())
+	defer rec.ObserveStage(decision.StageKratos, time.Now())
+
+	parent := tracer.Span(req.Context())
+	s.Tracer.ExtURL(parent, req.Method, "/")
+
+	r, err := s.client.NewRequest("GET", s.cfg.AuthServerURL+client.KratosWhoamiPath, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// only the session credential is passed on to kratos
+	var credential string
+	if token := req.Header.Get(HeaderXSessionToken); token != "" {
+		credential = "token:" + token
+		r.Header.Set(HeaderXSessionToken, token)
+	} else if c, err := req.Cookie(s.cfg.KratosSessionCookie); err == nil && c.Value != "" {
+		credential = "cookie:" + c.Value
+		r.AddCookie(&http.Cookie{Name: c.Name, Value: c.Value})
+	} else {
+		rec.SetReason(decision.ReasonMissingToken)
+		return nil, ErrUnauthorized
+	}
+
+	sum := sha256.Sum256([]byte(s.cfg.AuthServerURL + "\n" + credential))
+	key := hex.EncodeToString(sum[:])
+	sessions := cacheFor(rec, s.SessionCache)
+	if v, ok := sessions.Get(key); ok {
+		ks := v.(*KratosSession)
+		rec.SetRole(ks.Trait(s.cfg.KratosRoleTrait))
+		rec.Claims = ks.claims()
+		s.Tracer.ExtStatus(parent, http.StatusOK)
+		return ks, nil
+	}
+
+	child := s.Tracer.Child(req.Context(), r)
+	defer child.End()
+	s.Tracer.ExtURL(child, r.Method, fmt.Sprintf("%s://%s%s", r.URL.Scheme, r.URL.Host, r.URL.Path))
+	s.Tracer.Inject(child, r)
+
+	ks := &KratosSession{}
+	rStatusCode, err := s.client.Send(r, ks)
+	if err != nil {
+		rec.ObserveUpstream(decision.UpstreamKratos, 0)
+		rec.SetReason(decision.ReasonUpstreamError)
+		return nil, err
+	}
+
+	rec.ObserveUpstream(decision.UpstreamKratos, rStatusCode)
+	rec.Step(decision.StageKratos, nil, map[string]interface{}{
+		"session_id": ks.ID, "active": ks.Active, "expires_at": ks.ExpiresAt, "identity_id": ks.Identity.ID, "traits": redact.Claims(ks.Identity.Traits),
+	})
+	s.Tracer.ExtStatus(child, rStatusCode)
+
+	if rStatusCode != http.StatusOK || !ks.Active || ks.Identity.ID == "" {
+		rec.SetReason(decision.ReasonInactiveToken)
+		s.Tracer.ExtStatus(parent, http.StatusUnauthorized)
+		return nil, ErrUnauthorized
+	}
+
+	expiry := ks.ExpiresAt
+	if s.cfg.KratosCacheTTL > 0 && time.Now().Add(s.cfg.KratosCacheTTL).Before(expiry) {
+		expiry = time.Now().Add(s.cfg.KratosCacheTTL)
+	}
+	sessions.Set(key, ks, expiry)
+
+	rec.SetRole(ks.Trait(s.cfg.KratosRoleTrait))
+	rec.Claims = ks.claims()
+	s.Tracer.ExtStatus(parent, http.StatusOK)
+
+	return ks, nil
+}
@@ -0,0 +1,63 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"traefik-tower/pkg/decision"
+	"traefik-tower/pkg/ldapauth"
+)
+
+// LDAPAuth binds as the user of the basic auth credentials, the directory groups of the user are its roles.
+// Successful binds are cached for LDAPCacheTTL.
+func (s *Service) LDAPAuth(req *http.Request) (*ConsumerID, error) {
+	rec := decision.FromContext(req.Context())
+	defer rec.ObserveStage(decision.StageLDAP, time.Now())
+
+	if s.LDAP == nil {
+		return s.basicAuth(req, nil)
+	}
+
+	return s.basicAuth(req, func(user, password string) ([]string, error) {
+		// the password is part of the key so a changed password is not served from the cache
+		sum := sha256.Sum256([]byte(user + "\x00" + password))
+		key := hex.EncodeToString(sum[:])
+		binds := cacheFor(rec, s.BindCache)
+		if v, ok := binds.Get(key); ok {
+			return v.([]string), nil
+		}
+
+		u, err := s.LDAP.Authenticate(user, password)
+		switch err {
+		case nil:
+		case ldapauth.ErrInvalidCredentials, ldapauth.ErrUserNotFound:
+			rec.ObserveUpstream(decision.UpstreamLDAP, http.StatusUnauthorized)
+			rec.SetReason(decision.ReasonUnknownClient)
+			return nil, ErrUnauthorized
+		case ldapauth.ErrAmbiguousUser:
+			rec.ObserveUpstream(decision.UpstreamLDAP, http.StatusOK)
+			rec.SetReason(decision.ReasonUnknownSubject)
+			return nil, ErrUnauthorized
+		default:
+			log.Error().Err(err).Msg("ldap")
+			rec.ObserveUpstream(decision.UpstreamLDAP, 0)
+			rec.SetReason(decision.ReasonUpstreamError)
+			return nil, err
+		}
+
+		rec.ObserveUpstream(decision.UpstreamLDAP, http.StatusOK)
+		rec.Step(decision.StageLDAP, map[string]string{"user": user}, map[string]interface{}{"dn": u.DN, "groups": u.Groups})
+		if s.cfg.Debug {
+			log.Debug().Str("dn", u.DN).Strs("groups", u.Groups).Msg("ldap bind")
+		}
+		if s.cfg.LDAPCacheTTL > 0 {
+			binds.Set(key, u.Groups, time.Now().Add(s.cfg.LDAPCacheTTL))
+		}
+
+		return u.Groups, nil
+	})
+}
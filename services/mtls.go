@@ -0,0 +1,94 @@
+package services
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"traefik-tower/pkg/decision"
+	"traefik-tower/pkg/forward"
+	"traefik-tower/pkg/mtls"
+	"traefik-tower/pkg/tracer"
+)
+
+// MTLSClient verifies the client certificate forwarded by a trusted proxy and returns the consumer id
+func (s *Service) MTLSClient(req *http.Request) (*ConsumerID, error) {
+	rec := decision.FromContext(req.Context())
+	defer rec.ObserveStage(decision.StageMTLS, time.Now())
+
+	parent := tracer.Span(req.Context())
+	s.Tracer.ExtURL(parent, req.Method, "/")
+
+	header := forward.FromContext(req.Context()).ClientCert
+	if header == "" {
+		rec.SetReason(decision.ReasonMissingToken)
+		return nil, ErrUnauthorized
+	}
+
+	if s.MTLS == nil {
+		rec.SetReason(decision.ReasonNotConfigured)
+		s.Tracer.ExtStatus(parent, http.StatusInternalServerError)
+		return nil, ErrInternalServerError
+	}
+
+	certs, err := mtls.ParseHeader(header)
+	if err != nil {
+		rec.SetReason(decision.ReasonMissingToken)
+		s.Tracer.ExtStatus(parent, http.StatusUnauthorized)
+		return nil, ErrUnauthorized
+	}
+
+	// the certificate fingerprint identifies the credential in the audit log
+	sum := sha256.Sum256(certs[0].Raw)
+	rec.TokenHash = hex.EncodeToString(sum[:])
+
+	leaf, err := s.MTLS.Verify(certs)
+	if err != nil {
+		if s.cfg.Debug {
+			log.Debug().Err(err).Str("subject", certs[0].Subject.String()).Msg("client certificate rejected")
+		}
+		if err == mtls.ErrRevoked || mtls.IsExpired(err) {
+			rec.SetReason(decision.ReasonInactiveToken)
+		} else {
+			rec.SetReason(decision.ReasonUnknownClient)
+		}
+		s.Tracer.ExtStatus(parent, http.StatusUnauthorized)
+		return nil, ErrUnauthorized
+	}
+
+	id, err := mtls.ConsumerID(leaf, s.cfg.MTLSConsumerID, s.cfg.MTLSSpiffeTrustDomains)
+	if err != nil {
+		rec.SetReason(decision.ReasonUnknownSubject)
+		s.Tracer.ExtStatus(parent, http.StatusUnauthorized)
+		return nil, ErrUnauthorized
+	}
+
+	rec.Claims = certClaims(leaf)
+	rec.Step(decision.StageMTLS, nil, rec.Claims)
+	cID := ConsumerID(id)
+	s.Tracer.ExtStatus(parent, http.StatusOK)
+
+	return &cID, nil
+}
+
+// certClaims describe the client certificate to authorizers
+func certClaims(c *x509.Certificate) map[string]interface{} {
+	uris := make([]string, 0, len(c.URIs))
+	for _, u := range c.URIs {
+		uris = append(uris, u.String())
+	}
+
+	return map[string]interface{}{
+		"subject":   c.Subject.String(),
+		"issuer":    c.Issuer.String(),
+		"serial":    c.SerialNumber.String(),
+		"dns_names": c.DNSNames,
+		"emails":    c.EmailAddresses,
+		"uris":      uris,
+		"not_after": c.NotAfter.Unix(),
+	}
+}
@@ -0,0 +1,187 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"traefik-tower/pkg/client"
+	"traefik-tower/pkg/decision"
+	"traefik-tower/pkg/forward"
+	"traefik-tower/pkg/redact"
+	"traefik-tower/pkg/tracer"
+)
+
+// opaInput is the input document of the OPA policy
+type opaInput struct {
+	Request  opaRequest  `json:"request"`
+	Identity opaIdentity `json:"identity"`
+	Client   opaClient   `json:"client"`
+	Route    string      `json:"route"`
+	Tenant   string      `json:"tenant"`
+}
+
+type opaRequest struct {
+	Method   string              `json:"method"`
+	Host     string              `json:"host"`
+	URI      string              `json:"uri"`
+	Path     string              `json:"path"`
+	Query    map[string][]string `json:"query"`
+	Proto    string              `json:"proto"`
+	ClientIP string              `json:"client_ip"`
+	// Headers are lower case, credentials are masked
+	Headers map[string]string `json:"headers"`
+}
+
+type opaIdentity struct {
+	AuthType   string                 `json:"auth_type"`
+	ConsumerID string                 `json:"consumer_id"`
+	Roles      []string               `json:"roles"`
+	Pool       string                 `json:"pool,omitempty"`
+	Claims     map[string]interface{} `json:"claims"`
+}
+
+type opaClient struct {
+	Metadata map[string]interface{} `json:"metadata"`
+}
+
+// opaResult is the policy decision, either a boolean or an object with allow and response headers
+type opaResult struct {
+	Allow   bool              `json:"allow"`
+	Headers map[string]string `json:"headers"`
+}
+
+// OPAAllowed asks the OPA Data API for the decision on the authenticated request and returns the
+// headers the policy adds. It allows everything when no OPA is configured.
+func (s *Service) OPAAllowed(req *http.Request, consumerID string) (map[string]string, error) {
+	if s.OPA == nil {
+		return nil, nil
+	}
+
+	var resp struct {
+		Result json.RawMessage `json:"result"`
+	}
+
+	rec := decision.FromContext(req.Context())
+	defer rec.ObserveStage(decision.StageOPA, time.Now())
+
+	path := client.OPADataPath + strings.Trim(s.cfg.OPAPath, "/")
+	parent := tracer.Span(req.Context())
+
+	input := s.opaInput(req, rec, consumerID)
+	r, err := s.OPA.NewRequestJSON("POST", s.cfg.OPAURL+path, map[string]interface{}{"input": input})
+	if err != nil {
+		return nil, err
+	}
+
+	child := s.Tracer.Child(req.Context(), r)
+	defer child.End()
+	s.Tracer.ExtURL(child, r.Method, fmt.Sprintf("%s://%s%s", r.URL.Scheme, r.URL.Host, r.URL.Path))
+	s.Tracer.Inject(child, r)
+	r.Header.Set("Content-Type", "application/json")
+
+	rStatusCode, err := s.OPA.Send(r, &resp)
+	if err != nil {
+		rec.ObserveUpstream(decision.UpstreamOPA, 0)
+		rec.SetReason(decision.ReasonUpstreamError)
+		return nil, err
+	}
+
+	rec.ObserveUpstream(decision.UpstreamOPA, rStatusCode)
+	s.Tracer.ExtStatus(child, rStatusCode)
+
+	if rStatusCode != http.StatusOK {
+		rec.SetReason(decision.ReasonUpstreamError)
+		return nil, fmt.Errorf("opa: status %d", rStatusCode)
+	}
+
+	result, err := parseOPAResult(resp.Result)
+	if err != nil {
+		rec.SetReason(decision.ReasonUpstreamError)
+		return nil, err
+	}
+
+	rec.Step(decision.StageOPA, input, result)
+
+	if s.cfg.Debug {
+		log.Debug().Msgf("OPAAllowed: path=%s allow=%t headers=%v", path, result.Allow, result.Headers)
+	}
+
+	if !result.Allow {
+		rec.SetReason(decision.ReasonPolicyDenied)
+		s.Tracer.ExtStatus(parent, http.StatusUnauthorized)
+		return nil, ErrUnauthorized
+	}
+	s.Tracer.ExtStatus(parent, http.StatusOK)
+
+	return result.Headers, nil
+}
+
+// parseOPAResult reads a boolean or an object result, an undefined decision denies
+func parseOPAResult(raw json.RawMessage) (*opaResult, error) {
+	result := &opaResult{}
+	if len(raw) == 0 || string(raw) == "null" {
+		log.Warn().Msg("opa: the decision is undefined, check opa_path")
+		return result, nil
+	}
+
+	if err := json.Unmarshal(raw, &result.Allow); err == nil {
+		return result, nil
+	}
+	if err := json.Unmarshal(raw, result); err != nil {
+		return nil, fmt.Errorf("opa: result must be a boolean or an object with allow and headers: %w", err)
+	}
+
+	return result, nil
+}
+
+func (s *Service) opaInput(req *http.Request, rec *decision.Record, consumerID string) *opaInput {
+	fr := forward.FromContext(req.Context())
+
+	in := &opaInput{
+		Request: opaRequest{
+			Method:   fr.Method,
+			Host:     fr.Host,
+			URI:      redact.URI(fr.URI),
+			Path:     fr.URI,
+			Query:    map[string][]string{},
+			Proto:    fr.Proto,
+			ClientIP: fr.ClientIP,
+			Headers:  map[string]string{},
+		},
+		Identity: opaIdentity{
+			AuthType:   rec.AuthType,
+			ConsumerID: consumerID,
+			Roles:      rec.Roles,
+			Pool:       rec.Pool,
+			Claims:     rec.Claims,
+		},
+		Client: opaClient{Metadata: rec.ClientMetadata},
+		Route:  rec.Route,
+		Tenant: rec.Tenant,
+	}
+	if in.Identity.Roles == nil {
+		in.Identity.Roles = []string{}
+	}
+	if in.Identity.Claims == nil {
+		in.Identity.Claims = map[string]interface{}{}
+	}
+	if in.Client.Metadata == nil {
+		in.Client.Metadata = map[string]interface{}{}
+	}
+
+	if u, err := url.ParseRequestURI(fr.URI); err == nil {
+		in.Request.Path = u.Path
+		in.Request.Query = redact.Values(u.Query())
+	}
+	for name, values := range redact.Header(req.Header) {
+		in.Request.Headers[strings.ToLower(name)] = strings.Join(values, ", ")
+	}
+
+	return in
+}
@@ -0,0 +1,63 @@
+package services
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"traefik-tower/pkg/decision"
+	"traefik-tower/pkg/forward"
+	"traefik-tower/pkg/ratelimit"
+	"traefik-tower/pkg/route"
+)
+
+// RateLimit takes a request from the budget of the route rule. It returns ErrTooManyRequests with the
+// bucket state for the rate limit headers when the budget is spent. Store errors let the request pass.
+func (s *Service) RateLimit(req *http.Request, rule *route.Rule, consumerID string) (*ratelimit.Result, error) {
+	if rule == nil || rule.RateLimit == nil {
+		return nil, nil
+	}
+
+	rec := decision.FromContext(req.Context())
+	defer rec.ObserveStage(decision.StageRateLimit, time.Now())
+
+	rl := rule.RateLimit
+	limit := ratelimit.Limit{Requests: rl.Requests, Per: rl.Per, Burst: rl.Burst}
+	key := rateLimitKey(req, rec, rule, consumerID)
+
+	// dry runs leave the buckets alone
+	if rec.DryRun() || s.RateLimits == nil {
+		rec.Step(decision.StageRateLimit, map[string]interface{}{"key": key, "requests": rl.Requests, "per": rl.Per.String()}, nil)
+		return nil, nil
+	}
+
+	res, err := s.RateLimits.Take(key, limit)
+	if err != nil {
+		log.Error().Err(err).Str("route", rule.Name).Msg("rate limit store, allowing the request")
+		return nil, nil
+	}
+	if !res.Allowed {
+		rec.SetReason(decision.ReasonRateLimited)
+		return &res, ErrTooManyRequests
+	}
+
+	return &res, nil
+}
+
+// rateLimitKey scopes the bucket to the tenant and route, requests without the configured key use the client ip
+func rateLimitKey(req *http.Request, rec *decision.Record, rule *route.Rule, consumerID string) string {
+	kind, value := rule.RateLimit.Key, ""
+	switch kind {
+	case route.RateLimitKeyRole:
+		value = rec.Role
+	case route.RateLimitKeyClientIP:
+	default:
+		kind, value = route.RateLimitKeyConsumer, consumerID
+	}
+	if value == "" {
+		kind, value = route.RateLimitKeyClientIP, forward.FromContext(req.Context()).ClientIP
+	}
+
+	return rec.Tenant + "|" + rule.Name + "|" + kind + ":" + value
+}
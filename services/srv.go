@@ -8,21 +8,30 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"traefik-tower/config"
+	"traefik-tower/pkg/acp"
+	"traefik-tower/pkg/apikey"
+	"traefik-tower/pkg/cache"
 	"traefik-tower/pkg/client"
+	"traefik-tower/pkg/decision"
+	"traefik-tower/pkg/forward"
+	"traefik-tower/pkg/htpasswd"
+	"traefik-tower/pkg/ldapauth"
+	"traefik-tower/pkg/mtls"
+	"traefik-tower/pkg/ratelimit"
+	"traefik-tower/pkg/redact"
+	"traefik-tower/pkg/throttle"
 	"traefik-tower/pkg/tracer"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	cognito "github.com/aws/aws-sdk-go/service/cognitoidentityprovider"
-	"github.com/opentracing/opentracing-go"
 	"github.com/rs/zerolog/log"
 )
 
-const (
-	AuthBearer          = "Bearer"
-	HeaderXForwardedURI = "x-forwarded-uri"
-)
+const AuthBearer = "Bearer"
 
 type ConsumerID string
 
@@ -35,25 +44,44 @@ type CError error
 var (
 	ErrUnauthorized        CError = errors.New(http.StatusText(http.StatusUnauthorized))
 	ErrInternalServerError CError = errors.New(http.StatusText(http.StatusInternalServerError))
+	ErrTooManyRequests     CError = errors.New(http.StatusText(http.StatusTooManyRequests))
 )
 
 type Service struct {
-	CognitoClient *cognito.CognitoIdentityProvider
-	client        *client.HTTPClient
-	Tracer        tracer.ITracer
-	cfg           *config.Config
+	CognitoPools []*CognitoPool
+	APIKeys      *apikey.Store
+	MTLS         *mtls.Verifier
+	// ACP replaces keto with in process policies when set
+	ACP *acp.Engine
+	// OPA is the client of the OPA sidecar asked after authentication when set
+	OPA      *client.HTTPClient
+	Htpasswd *htpasswd.File
+	LDAP     *ldapauth.Authenticator
+	// BindCache holds the groups of successful LDAP binds
+	BindCache *cache.Cache
+	// BasicThrottle counts failed basic auth attempts per user and client ip
+	BasicThrottle *throttle.Limiter
+	// BruteForce counts invalid credentials per client ip, shared by all services of the process
+	BruteForce *throttle.Limiter
+	// RateLimits keeps the token buckets of the route rate limits, shared by all services of the process
+	RateLimits ratelimit.Store
+	// SessionCache holds Kratos sessions, shared by all services of the process
+	SessionCache *cache.Cache
+	client       *client.HTTPClient
+	Tracer       tracer.ITracer
+	cfg          *config.Config
 }
 
 func NewService(
 	cfg *config.Config,
 	c *client.HTTPClient,
 	tr tracer.ITracer,
-	cn *cognito.CognitoIdentityProvider) *Service {
+	pools []*CognitoPool) *Service {
 	return &Service{
-		CognitoClient: cn,
-		cfg:           cfg,
-		client:        c,
-		Tracer:        tr,
+		CognitoPools: pools,
+		cfg:          cfg,
+		client:       c,
+		Tracer:       tr,
 	}
 }
 
@@ -63,11 +91,15 @@ func (s *Service) HydraIntrospect(req *http.Request) (*ConsumerID, error) {
 		authResp authHydraServerResponse
 	)
 
-	s.Tracer.Parent(req)
-	s.Tracer.ExtURL(s.Tracer.GetParentSpan(), req.Method, "/")
+	rec := decision.FromContext(req.Context())
+	defer rec.ObserveStage(decision.StageIntrospect, time.Now())
+
+	parent := tracer.Span(req.Context())
+	s.Tracer.ExtURL(parent, req.Method, "/")
 
 	splitHeader, err := checkAuthBearer(req)
 	if err != nil {
+		rec.SetReason(decision.ReasonMissingToken)
 		return nil, err
 	}
 
@@ -80,17 +112,12 @@ func (s *Service) HydraIntrospect(req *http.Request) (*ConsumerID, error) {
 		return nil, err
 	}
 
-	err = s.Tracer.Child(r)
-	if err != nil {
-		log.Error().Err(err).Msg("tracer child span")
-	}
-	s.Tracer.ExtURL(s.Tracer.GetChildSpan(), r.Method, fmt.Sprintf("%s://%s%s", r.URL.Scheme, r.URL.Host, r.URL.Path))
+	child := s.Tracer.Child(req.Context(), r)
+	defer child.End()
+	s.Tracer.ExtURL(child, r.Method, fmt.Sprintf("%s://%s%s", r.URL.Scheme, r.URL.Host, r.URL.Path))
 
 	// Inject headers to r(equest) obj to
-	err = s.Tracer.GetTracer().Inject(s.Tracer.GetChildSpan().Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
-	if err != nil {
-		log.Error().Err(err).Msg("tracer inject span")
-	}
+	s.Tracer.Inject(child, r)
 
 	r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 	r.Header.Add("X-Forwarded-Proto", "https")
@@ -98,18 +125,24 @@ func (s *Service) HydraIntrospect(req *http.Request) (*ConsumerID, error) {
 
 	rStatusCode, err := s.client.Send(r, &authResp)
 	if err != nil {
+		rec.ObserveUpstream(decision.UpstreamHydra, 0)
+		rec.SetReason(decision.ReasonUpstreamError)
 		return nil, err
 	}
 
-	s.Tracer.ExtStatus(s.Tracer.GetChildSpan(), rStatusCode)
+	rec.ObserveUpstream(decision.UpstreamHydra, rStatusCode)
+	rec.Step(decision.StageIntrospect, map[string]string{"token": rec.TokenHash}, authResp)
+	s.Tracer.ExtStatus(child, rStatusCode)
 
 	if !authResp.Active {
-		s.Tracer.ExtStatus(s.Tracer.GetParentSpan(), http.StatusUnauthorized)
+		rec.SetReason(decision.ReasonInactiveToken)
+		s.Tracer.ExtStatus(parent, http.StatusUnauthorized)
 		return nil, ErrUnauthorized
 	}
 
+	rec.Claims = authResp.claims()
 	cID := ConsumerID(authResp.ClientID)
-	s.Tracer.ExtStatus(s.Tracer.GetParentSpan(), http.StatusOK)
+	s.Tracer.ExtStatus(parent, http.StatusOK)
 
 	return &cID, nil
 }
@@ -120,17 +153,16 @@ func (s *Service) HydraClient(req *http.Request, cID string) (HydraClientInfoRes
 		resp HydraClientInfoResponse
 	)
 
+	rec := decision.FromContext(req.Context())
+	defer rec.ObserveStage(decision.StageClientLookup, time.Now())
+
 	patch := strings.ReplaceAll(client.ClientsIDHydraPath, `{id}`, cID)
 
-	if !s.Tracer.IsParentSpan() {
-		s.Tracer.Parent(req)
-		s.Tracer.ExtURL(s.Tracer.GetParentSpan(), req.Method, "/")
-	} else {
-		s.Tracer.ExtURL(s.Tracer.GetChildSpan(), req.Method, patch)
-	}
+	parent := tracer.Span(req.Context())
 
 	splitHeader, err := checkAuthBearer(req)
 	if err != nil {
+		rec.SetReason(decision.ReasonMissingToken)
 		return resp, err
 	}
 
@@ -140,17 +172,12 @@ func (s *Service) HydraClient(req *http.Request, cID string) (HydraClientInfoRes
 		return resp, err
 	}
 
-	err = s.Tracer.Child(r)
-	if err != nil {
-		log.Error().Err(err).Msg("tracer child span")
-	}
-	s.Tracer.ExtURL(s.Tracer.GetChildSpan(), r.Method, fmt.Sprintf("%s://%s%s", r.URL.Scheme, r.URL.Host, r.URL.Path))
+	child := s.Tracer.Child(req.Context(), r)
+	defer child.End()
+	s.Tracer.ExtURL(child, r.Method, fmt.Sprintf("%s://%s%s", r.URL.Scheme, r.URL.Host, r.URL.Path))
 
 	// Inject headers to r(equest) obj to
-	err = s.Tracer.GetTracer().Inject(s.Tracer.GetChildSpan().Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
-	if err != nil {
-		log.Error().Err(err).Msg("tracer inject span")
-	}
+	s.Tracer.Inject(child, r)
 
 	bearer := "Bearer " + splitHeader[1]
 	r.Header.Set("Authorization", bearer)
@@ -158,58 +185,57 @@ func (s *Service) HydraClient(req *http.Request, cID string) (HydraClientInfoRes
 
 	rStatusCode, err := s.client.Send(r, &resp)
 	if err != nil {
+		rec.ObserveUpstream(decision.UpstreamHydra, 0)
+		rec.SetReason(decision.ReasonUpstreamError)
 		return resp, err
 	}
 
+	rec.ObserveUpstream(decision.UpstreamHydra, rStatusCode)
+	rec.Step(decision.StageClientLookup, map[string]string{"client_id": cID},
+		map[string]interface{}{"client_id": resp.ClientID, "role": resp.GetRole(), "metadata": redact.Claims(resp.Metadata)})
+
 	if s.cfg.Debug {
-		log.Debug().Msgf("hydraClientInfoResponse: %#v\n", resp)
+		log.Debug().Msgf("hydraClientInfoResponse: client_id=%s metadata=%v", resp.ClientID, redact.Claims(resp.Metadata))
 	}
 
-	s.Tracer.ExtStatus(s.Tracer.GetChildSpan(), rStatusCode)
+	s.Tracer.ExtStatus(child, rStatusCode)
 
 	if resp.ClientID == "" {
-		s.Tracer.ExtStatus(s.Tracer.GetParentSpan(), http.StatusUnauthorized)
+		rec.SetReason(decision.ReasonUnknownClient)
+		s.Tracer.ExtStatus(parent, http.StatusUnauthorized)
 		return resp, ErrUnauthorized
 	}
 
-	s.Tracer.ExtStatus(s.Tracer.GetParentSpan(), http.StatusOK)
+	rec.SetRole(resp.GetRole())
+	rec.ClientMetadata = resp.Metadata
+
+	s.Tracer.ExtStatus(parent, http.StatusOK)
 
 	return resp, nil
 }
 
 func (s *Service) HydraKetoAllowed(req *http.Request, subject string) error {
 	var (
-		err         error
-		authRequest authHydraKetoAllowedRequest
-		authResp    authHydraKetoAllowedResponse
-		resource    string
-		forwardPath string
+		err      error
+		authResp authHydraKetoAllowedResponse
 	)
 
-	if !s.Tracer.IsParentSpan() {
-		s.Tracer.Parent(req)
-		s.Tracer.ExtURL(s.Tracer.GetParentSpan(), req.Method, client.KetoEnginesAcpGlobAllowed)
-	} else {
-		s.Tracer.ExtURL(s.Tracer.GetChildSpan(), req.Method, client.KetoEnginesAcpGlobAllowed)
+	if s.ACP != nil {
+		return s.ACPAllowed(req, subject)
 	}
 
+	rec := decision.FromContext(req.Context())
+	defer rec.ObserveStage(decision.StageKeto, time.Now())
+
+	parent := tracer.Span(req.Context())
+
 	// check keto url
 	if s.cfg.KetoURL == "" {
+		rec.SetReason(decision.ReasonNotConfigured)
 		return ErrUnauthorized
 	}
 
-	forwardPath = getHeader(req, HeaderXForwardedURI)
-
-	rPath := strings.ReplaceAll(strings.Trim(forwardPath, "/"), `/`, `:`)
-	if rPath == "" {
-		resource = "home"
-	} else {
-		resource = rPath
-	}
-
-	authRequest.Action = req.Method
-	authRequest.Subject = subject
-	authRequest.Resource = resource
+	authRequest := ketoRequest(req, subject)
 
 	if s.cfg.Debug {
 		log.Debug().Msgf("HydraKetoAllowed::authRequest %v", authRequest)
@@ -221,48 +247,69 @@ func (s *Service) HydraKetoAllowed(req *http.Request, subject string) error {
 		return err
 	}
 
-	err = s.Tracer.Child(r)
-	if err != nil {
-		log.Error().Err(err).Msg("tracer child span")
-	}
-	s.Tracer.ExtURL(s.Tracer.GetChildSpan(), r.Method, fmt.Sprintf("%s://%s%s", r.URL.Scheme, r.URL.Host, r.URL.Path))
+	child := s.Tracer.Child(req.Context(), r)
+	defer child.End()
+	s.Tracer.ExtURL(child, r.Method, fmt.Sprintf("%s://%s%s", r.URL.Scheme, r.URL.Host, r.URL.Path))
 
 	// Inject headers to r(equest) obj to
-	err = s.Tracer.GetTracer().Inject(s.Tracer.GetChildSpan().Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
-	if err != nil {
-		log.Error().Err(err).Msg("tracer inject span")
-	}
+	s.Tracer.Inject(child, r)
 
 	r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 	r.Header.Add("X-Forwarded-Proto", "https")
 
 	rStatusCode, err := s.client.Send(r, &authResp)
 	if err != nil {
+		rec.ObserveUpstream(decision.UpstreamKeto, 0)
+		rec.SetReason(decision.ReasonUpstreamError)
 		return err
 	}
 
-	s.Tracer.ExtStatus(s.Tracer.GetChildSpan(), rStatusCode)
+	rec.ObserveUpstream(decision.UpstreamKeto, rStatusCode)
+	rec.Step(decision.StageKeto, authRequest, authResp)
+	s.Tracer.ExtStatus(child, rStatusCode)
 
 	if !authResp.Allowed {
-		s.Tracer.ExtStatus(s.Tracer.GetParentSpan(), http.StatusUnauthorized)
+		rec.SetReason(decision.ReasonPolicyDenied)
+		s.Tracer.ExtStatus(parent, http.StatusUnauthorized)
 		return ErrUnauthorized
 	}
-	s.Tracer.ExtStatus(s.Tracer.GetParentSpan(), http.StatusOK)
+	s.Tracer.ExtStatus(parent, http.StatusOK)
 
 	return nil
 }
 
+// ketoRequest maps the forwarded request to the ACP request of subject
+func ketoRequest(req *http.Request, subject string) authHydraKetoAllowedRequest {
+	fr := forward.FromContext(req.Context())
+
+	// the action is the method of the original request, not of the auth subrequest
+	action := fr.Method
+	if action == "" {
+		action = req.Method
+	}
+
+	return authHydraKetoAllowedRequest{
+		Subject:  subject,
+		Resource: acp.Resource(fr.URI),
+		Action:   action,
+	}
+}
+
 func (s *Service) CognitoUserInfo(req *http.Request) (*ConsumerID, error) {
 	var (
 		err      error
 		authResp authCognitoServiceResponse
 	)
 
-	s.Tracer.Parent(req)
-	s.Tracer.ExtURL(s.Tracer.GetParentSpan(), req.Method, "/")
+	rec := decision.FromContext(req.Context())
+	defer rec.ObserveStage(decision.StageCognito, time.Now())
+
+	parent := tracer.Span(req.Context())
+	s.Tracer.ExtURL(parent, req.Method, "/")
 
 	splitHeader, err := checkAuthBearer(req)
 	if err != nil {
+		rec.SetReason(decision.ReasonMissingToken)
 		return nil, err
 	}
 
@@ -272,42 +319,43 @@ func (s *Service) CognitoUserInfo(req *http.Request) (*ConsumerID, error) {
 		return nil, err
 	}
 
-	err = s.Tracer.Child(r)
-	if err != nil {
-		log.Error().Err(err).Msg("tracer child span")
-	}
-	s.Tracer.ExtURL(s.Tracer.GetChildSpan(), r.Method, fmt.Sprintf("%s://%s%s", r.URL.Scheme, r.URL.Host, r.URL.Path))
+	child := s.Tracer.Child(req.Context(), r)
+	defer child.End()
+	s.Tracer.ExtURL(child, r.Method, fmt.Sprintf("%s://%s%s", r.URL.Scheme, r.URL.Host, r.URL.Path))
 
 	bearer := "Bearer " + splitHeader[1]
 	r.Header.Set("Authorization", bearer)
 	r.Header.Set("X-Forwarded-Proto", "https")
 
 	// Inject headers to r(equest) obj to
-	err = s.Tracer.GetTracer().Inject(s.Tracer.GetChildSpan().Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
-	if err != nil {
-		log.Error().Err(err).Msg("tracer inject span")
-	}
+	s.Tracer.Inject(child, r)
 
 	if s.cfg.Debug {
-		for name, values := range r.Header {
+		for name, values := range redact.Header(r.Header) {
 			log.Debug().Msgf("header: %v => %#v", name, values)
 		}
 	}
 
 	rStatusCode, err := s.client.Send(r, &authResp)
 	if err != nil {
+		rec.ObserveUpstream(decision.UpstreamCognito, 0)
+		rec.SetReason(decision.ReasonUpstreamError)
 		return nil, err
 	}
 
-	s.Tracer.ExtStatus(s.Tracer.GetChildSpan(), rStatusCode)
+	rec.ObserveUpstream(decision.UpstreamCognito, rStatusCode)
+	rec.Step(decision.StageCognito, nil, redact.Claims(authResp.claims()))
+	s.Tracer.ExtStatus(child, rStatusCode)
 
 	if authResp.Sub == "" {
-		s.Tracer.ExtStatus(s.Tracer.GetParentSpan(), http.StatusUnauthorized)
+		rec.SetReason(decision.ReasonUnknownSubject)
+		s.Tracer.ExtStatus(parent, http.StatusUnauthorized)
 		return nil, ErrUnauthorized
 	}
 
+	rec.Claims = authResp.claims()
 	cID := ConsumerID(authResp.Sub)
-	s.Tracer.ExtStatus(s.Tracer.GetParentSpan(), http.StatusOK)
+	s.Tracer.ExtStatus(parent, http.StatusOK)
 
 	return &cID, nil
 }
@@ -318,59 +366,111 @@ func (s *Service) CognitoAWSUserInfo(req *http.Request) (*ConsumerID, error) {
 		user *cognito.GetUserOutput
 	)
 
-	s.Tracer.Parent(req)
-	s.Tracer.ExtURL(s.Tracer.GetParentSpan(), req.Method, "/")
+	rec := decision.FromContext(req.Context())
+	defer rec.ObserveStage(decision.StageCognitoAWS, time.Now())
+
+	parent := tracer.Span(req.Context())
+	s.Tracer.ExtURL(parent, req.Method, "/")
 
 	splitHeader, err := checkAuthBearer(req)
 	if err != nil {
+		rec.SetReason(decision.ReasonMissingToken)
 		return nil, err
 	}
 
-	if s.CognitoClient == nil {
-		s.Tracer.ExtStatus(s.Tracer.GetParentSpan(), http.StatusInternalServerError)
+	if len(s.CognitoPools) == 0 {
+		rec.SetReason(decision.ReasonNotConfigured)
+		s.Tracer.ExtStatus(parent, http.StatusInternalServerError)
 		return nil, ErrInternalServerError
 	}
 
+	// select the user pool by the token issuer
+	pool, reason := s.cognitoPool(splitHeader[1])
+	if pool == nil {
+		rec.SetReason(reason)
+		s.Tracer.ExtStatus(parent, http.StatusUnauthorized)
+		return nil, ErrUnauthorized
+	}
+	rec.Pool = pool.Name
+
 	// check used context
 	if s.cfg.IsAWSContext() {
-		user, err = s.CognitoClient.GetUserWithContext(context.Background(), &cognito.GetUserInput{AccessToken: aws.String(splitHeader[1])})
-		if err != nil {
-			return nil, err
-		}
+		user, err = pool.Client.GetUserWithContext(context.Background(), &cognito.GetUserInput{AccessToken: aws.String(splitHeader[1])})
 	} else {
-		user, err = s.CognitoClient.GetUser(&cognito.GetUserInput{AccessToken: aws.String(splitHeader[1])})
-		if err != nil {
-			return nil, err
-		}
+		user, err = pool.Client.GetUser(&cognito.GetUserInput{AccessToken: aws.String(splitHeader[1])})
+	}
+	if err != nil {
+		return nil, cognitoAWSError(rec, err)
 	}
 
+	rec.ObserveUpstream(decision.UpstreamCognitoAWS, http.StatusOK)
+	rec.Step(decision.StageCognitoAWS, map[string]string{"pool": pool.Name},
+		map[string]interface{}{"username": aws.StringValue(user.Username), "attributes": redactAttributes(user.UserAttributes)})
+
 	if s.cfg.Debug {
-		log.Debug().Msgf("userInfo: %#v", user)
+		log.Debug().Msgf("userInfo: username=%s attributes=%v", aws.StringValue(user.Username), redactAttributes(user.UserAttributes))
 	}
 
-	err = s.Tracer.Child(req)
-	if err != nil {
-		log.Error().Err(err).Msg("tracer child span")
-	}
-	s.Tracer.ExtURL(s.Tracer.GetChildSpan(), "GET", "/oauth2/userInfo")
+	child := s.Tracer.Child(req.Context(), req)
+	defer child.End()
+	s.Tracer.ExtURL(child, "GET", "/oauth2/userInfo")
 
 	// Inject headers to r(equest) obj to
-	err = s.Tracer.GetTracer().Inject(s.Tracer.GetChildSpan().Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(req.Header))
-	if err != nil {
-		log.Error().Err(err).Msg("tracer inject span")
-	}
+	s.Tracer.Inject(child, req)
 
 	if user.Username == nil {
-		s.Tracer.ExtStatus(s.Tracer.GetParentSpan(), http.StatusUnauthorized)
+		rec.SetReason(decision.ReasonUnknownSubject)
+		s.Tracer.ExtStatus(parent, http.StatusUnauthorized)
 		return nil, ErrUnauthorized
 	}
 
+	rec.Claims = map[string]interface{}{"username": aws.StringValue(user.Username)}
+	for _, a := range user.UserAttributes {
+		rec.Claims[aws.StringValue(a.Name)] = aws.StringValue(a.Value)
+	}
 	cID := ConsumerID(aws.StringValue(user.Username))
-	s.Tracer.ExtStatus(s.Tracer.GetParentSpan(), http.StatusOK)
+	s.Tracer.ExtStatus(parent, http.StatusOK)
 
 	return &cID, nil
 }
 
+// cognitoAWSError records the SDK error and maps rejected tokens to ErrUnauthorized
+func cognitoAWSError(rec *decision.Record, err error) error {
+	reqErr, ok := err.(awserr.RequestFailure)
+	if !ok {
+		rec.ObserveUpstream(decision.UpstreamCognitoAWS, 0)
+		rec.SetReason(decision.ReasonUpstreamError)
+		return err
+	}
+
+	rec.ObserveUpstream(decision.UpstreamCognitoAWS, reqErr.StatusCode())
+	if reqErr.Code() == cognito.ErrCodeNotAuthorizedException || reqErr.Code() == cognito.ErrCodeUserNotFoundException {
+		rec.SetReason(decision.ReasonInactiveToken)
+		return ErrUnauthorized
+	}
+
+	rec.SetReason(decision.ReasonUpstreamError)
+	return err
+}
+
+// redactAttributes masks Cognito user attributes named in the redacted claims
+func redactAttributes(attrs []*cognito.AttributeType) map[string]interface{} {
+	m := make(map[string]interface{}, len(attrs))
+	for _, a := range attrs {
+		m[aws.StringValue(a.Name)] = aws.StringValue(a.Value)
+	}
+
+	return redact.Claims(m)
+}
+
+// cacheFor leaves caches alone in dry runs, a nil cache caches nothing
+func cacheFor(rec *decision.Record, c *cache.Cache) *cache.Cache {
+	if rec.DryRun() {
+		return nil
+	}
+	return c
+}
+
 // Process Authorization Header
 func checkAuthBearer(req *http.Request) ([]string, error) {
 	var splitHeader []string
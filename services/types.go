@@ -46,3 +46,26 @@ type authHydraKetoAllowedRequest struct {
 type authHydraKetoAllowedResponse struct {
 	Allowed bool `json:"allowed"`
 }
+
+func (r *authHydraServerResponse) claims() map[string]interface{} {
+	return map[string]interface{}{
+		"sub":        r.Sub,
+		"client_id":  r.ClientID,
+		"scope":      r.Scope,
+		"iss":        r.Iss,
+		"exp":        r.Exp,
+		"iat":        r.Iat,
+		"token_type": r.TokenType,
+	}
+}
+
+func (r *authCognitoServiceResponse) claims() map[string]interface{} {
+	return map[string]interface{}{
+		"sub":                r.Sub,
+		"name":               r.Name,
+		"given_name":         r.GivenName,
+		"family_name":        r.FamilyName,
+		"preferred_username": r.PreferredUsername,
+		"email":              r.Email,
+	}
+}